@@ -0,0 +1,276 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What becomes of a request, decided ahead of the rate limiter.
+type Action int
+
+const (
+	// the request is put to the limiter as usual
+	Limit Action = iota
+	// the request bypasses the limiter entirely
+	Exempt
+	// the request is refused outright
+	Deny
+)
+
+// A rule matching requests by exactly one of tenant, client address or header.
+type Entry struct {
+	Action Action
+
+	TenantId string
+	// a network such as "203.0.113.0/24", or a single address
+	CIDR string
+	// Matches requests carrying the header with the given value, or any value when Value
+	// is empty. A Value ending in * matches any value with the preceding prefix.
+	//
+	// Clients can send whatever headers they please, so only Deny is safe for any header.
+	// An Exempt header entry lets every client that sends the header bypass the limiter, so
+	// only use one when the header is set by something trusted, such as a gateway in front
+	// of the service.
+	Header string
+	Value  string
+
+	// zero for entries which never expire
+	Expires time.Time
+}
+
+type Config struct {
+	// The client address matched against CIDR entries, the connection's remote address
+	// when nil. Give it a ratelimit.ClientIPIdentifier to see past trusted proxies.
+	ClientIP func(req *http.Request) string
+	Clock    ratelimit.Clock
+}
+
+// A set of entries consulted ahead of the rate limiter. When entries disagree about a
+// request, Deny beats Exempt. Entries may be swapped wholesale with Replace, e.g. when
+// their source is reloaded, or added to with Add, e.g. to ban a tenant for an hour.
+type Rules struct {
+	config Config
+
+	// writers build a new set from entries and swap it in, readers never wait
+	mutex   sync.Mutex
+	entries []Entry
+	current atomic.Pointer[ruleSet]
+}
+
+func NewRules(config Config, entries ...Entry) (*Rules, error) {
+	if config.ClientIP == nil {
+		config.ClientIP = remoteAddr
+	}
+	if config.Clock == nil {
+		config.Clock = ratelimit.HardwareClock{}
+	}
+	rules := &Rules{config: config}
+	if err := rules.Replace(entries...); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Discards every entry, including those added with Add, in favour of the given ones.
+// Nothing changes if any entry is invalid.
+func (rules *Rules) Replace(entries ...Entry) error {
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	return rules.swap(append([]Entry{}, entries...))
+}
+
+func (rules *Rules) Add(entries ...Entry) error {
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	return rules.swap(append(rules.entries[:len(rules.entries):len(rules.entries)], entries...))
+}
+
+// must hold the mutex
+func (rules *Rules) swap(entries []Entry) error {
+	now := rules.config.Clock.Now()
+	live := entries[:0]
+	for _, entry := range entries {
+		if entry.Expires.IsZero() || entry.Expires.After(now) {
+			live = append(live, entry)
+		}
+	}
+	set, err := compile(live)
+	if err != nil {
+		return err
+	}
+	rules.entries = live
+	rules.current.Store(set)
+	return nil
+}
+
+func (rules *Rules) Evaluate(req *http.Request, tenantId string) Action {
+	set := rules.current.Load()
+	now := rules.config.Clock.Now()
+
+	action := set.tenants[tenantId].action(now)
+	if addr, ok := parseAddr(rules.config.ClientIP(req)); ok {
+		action = max(action, set.networks.lookup(addr, now))
+	}
+	for _, matcher := range set.headers {
+		if action == Deny {
+			break
+		}
+		if matcher.matches(req) {
+			action = max(action, matcher.verdicts.action(now))
+		}
+	}
+	return action
+}
+
+// Wraps a rate limiting middleware, e.g. one from ratelimit.Middleware, so that exempt
+// requests skip it and denied requests never reach it. tenantIdentifier should be the
+// one given to the rate limiter.
+func (rules *Rules) Middleware(
+	tenantIdentifier func(r *http.Request) string,
+	limit func(servlet http.Handler) http.HandlerFunc,
+) func(servlet http.Handler) http.HandlerFunc {
+	return func(servlet http.Handler) http.HandlerFunc {
+		limitedServlet := limit(servlet)
+		return func(resp http.ResponseWriter, req *http.Request) {
+			switch rules.Evaluate(req, tenantIdentifier(req)) {
+			case Exempt:
+				servlet.ServeHTTP(resp, req)
+			case Deny:
+				resp.WriteHeader(http.StatusForbidden)
+				io.WriteString(resp, "Access denied.")
+			default:
+				limitedServlet.ServeHTTP(resp, req)
+			}
+		}
+	}
+}
+
+type verdict struct {
+	action  Action
+	expires time.Time
+}
+
+type verdicts []verdict
+
+// the strongest verdict still in force
+func (vs verdicts) action(now time.Time) Action {
+	action := Limit
+	for _, v := range vs {
+		if v.expires.IsZero() || v.expires.After(now) {
+			action = max(action, v.action)
+		}
+	}
+	return action
+}
+
+type headerMatcher struct {
+	name     string
+	value    string
+	verdicts verdicts
+}
+
+func (matcher *headerMatcher) matches(req *http.Request) bool {
+	values, ok := req.Header[matcher.name]
+	if !ok || matcher.value == "" {
+		return ok
+	}
+	prefix, isPrefix := strings.CutSuffix(matcher.value, "*")
+	for _, value := range values {
+		if value == matcher.value || (isPrefix && strings.HasPrefix(value, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleSet struct {
+	tenants  map[string]verdicts
+	networks *networkTrie
+	headers  []*headerMatcher
+}
+
+var ambiguousEntryError = errors.New("entries must match by exactly one of tenant, CIDR or header")
+
+func compile(entries []Entry) (*ruleSet, error) {
+	set := &ruleSet{tenants: map[string]verdicts{}, networks: &networkTrie{}}
+	headers := map[[2]string]*headerMatcher{}
+	for _, entry := range entries {
+		if entry.Action != Exempt && entry.Action != Deny {
+			return nil, fmt.Errorf("entry %+v: action must be Exempt or Deny", entry)
+		}
+		v := verdict{action: entry.Action, expires: entry.Expires}
+
+		kinds := 0
+		for _, field := range []string{entry.TenantId, entry.CIDR, entry.Header} {
+			if field != "" {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("entry %+v: %w", entry, ambiguousEntryError)
+		}
+
+		switch {
+		case entry.TenantId != "":
+			set.tenants[entry.TenantId] = append(set.tenants[entry.TenantId], v)
+		case entry.CIDR != "":
+			prefix, err := parsePrefix(entry.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			set.networks.insert(prefix, v)
+		default:
+			key := [2]string{http.CanonicalHeaderKey(entry.Header), entry.Value}
+			matcher, ok := headers[key]
+			if !ok {
+				matcher = &headerMatcher{name: key[0], value: key[1]}
+				headers[key] = matcher
+				set.headers = append(set.headers, matcher)
+			}
+			matcher.verdicts = append(matcher.verdicts, v)
+		}
+	}
+	return set, nil
+}
+
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(cidr); err == nil {
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// accepts addresses with or without ports, and the prefixes of grouped IPv6 clients
+func parseAddr(client string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if addr, err := netip.ParseAddr(client); err == nil {
+		return addr.Unmap(), true
+	}
+	if prefix, err := netip.ParsePrefix(client); err == nil {
+		return prefix.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func remoteAddr(req *http.Request) string {
+	return req.RemoteAddr
+}
@@ -0,0 +1,141 @@
+package access
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, 3, 12, 10, 10, 10, 0, time.UTC)
+
+func request(remoteAddr string, headers ...string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	return req
+}
+
+func newRules(t *testing.T, clock ratelimit.Clock, entries ...Entry) *Rules {
+	rules, err := NewRules(Config{Clock: clock}, entries...)
+	assert.NoError(t, err)
+	return rules
+}
+
+func Test_tenants_may_be_exempted_or_denied(t *testing.T) {
+	rules := newRules(t, nil,
+		Entry{Action: Exempt, TenantId: "internal"},
+		Entry{Action: Deny, TenantId: "abuser"},
+	)
+
+	assert.Equal(t, Exempt, rules.Evaluate(request("192.0.2.1:1"), "internal"))
+	assert.Equal(t, Deny, rules.Evaluate(request("192.0.2.1:1"), "abuser"))
+	assert.Equal(t, Limit, rules.Evaluate(request("192.0.2.1:1"), "anyone"))
+}
+
+func Test_networks_match_every_address_within_them(t *testing.T) {
+	rules := newRules(t, nil,
+		Entry{Action: Exempt, CIDR: "10.0.0.0/8"},
+		Entry{Action: Deny, CIDR: "10.6.6.0/24"},
+		Entry{Action: Exempt, CIDR: "2001:db8::/32"},
+		Entry{Action: Deny, CIDR: "198.51.100.7"},
+	)
+
+	assert.Equal(t, Exempt, rules.Evaluate(request("10.1.2.3:1"), "t"))
+	assert.Equal(t, Deny, rules.Evaluate(request("10.6.6.6:1"), "t"), "the narrower denial wins")
+	assert.Equal(t, Exempt, rules.Evaluate(request("[2001:db8:1::1]:1"), "t"))
+	assert.Equal(t, Exempt, rules.Evaluate(request("[::ffff:10.0.0.1]:1"), "t"))
+	assert.Equal(t, Deny, rules.Evaluate(request("198.51.100.7:1"), "t"))
+	assert.Equal(t, Limit, rules.Evaluate(request("198.51.100.8:1"), "t"))
+	assert.Equal(t, Limit, rules.Evaluate(request("[2001:db9::1]:1"), "t"))
+	assert.Equal(t, Limit, rules.Evaluate(request("not an address"), "t"))
+}
+
+func Test_denial_beats_exemption(t *testing.T) {
+	rules := newRules(t, nil,
+		Entry{Action: Exempt, TenantId: "partner"},
+		Entry{Action: Deny, CIDR: "0.0.0.0/0"},
+	)
+
+	assert.Equal(t, Deny, rules.Evaluate(request("192.0.2.1:1"), "partner"))
+}
+
+func Test_headers_match_exactly_by_prefix_or_by_presence(t *testing.T) {
+	rules := newRules(t, nil,
+		Entry{Action: Exempt, Header: "user-agent", Value: "kube-probe/*"},
+		Entry{Action: Exempt, Header: "X-Internal-Check"},
+		Entry{Action: Deny, Header: "X-Bot", Value: "bad"},
+	)
+
+	assert.Equal(t, Exempt, rules.Evaluate(request("192.0.2.1:1", "User-Agent", "kube-probe/1.29"), "t"))
+	assert.Equal(t, Exempt, rules.Evaluate(request("192.0.2.1:1", "X-Internal-Check", ""), "t"))
+	assert.Equal(t, Deny, rules.Evaluate(request("192.0.2.1:1", "X-Bot", "good", "X-Bot", "bad"), "t"))
+	assert.Equal(t, Limit, rules.Evaluate(request("192.0.2.1:1", "User-Agent", "curl/8"), "t"))
+}
+
+func Test_entries_expire(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	rules := newRules(t, clock, Entry{Action: Exempt, CIDR: "10.0.0.0/8"})
+	assert.NoError(t, rules.Add(
+		Entry{Action: Deny, TenantId: "abuser", Expires: start.Add(time.Hour)},
+		Entry{Action: Deny, CIDR: "10.0.0.1", Expires: start.Add(time.Minute)},
+	))
+
+	assert.Equal(t, Deny, rules.Evaluate(request("192.0.2.1:1"), "abuser"))
+	assert.Equal(t, Deny, rules.Evaluate(request("10.0.0.1:1"), "t"))
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, Exempt, rules.Evaluate(request("10.0.0.1:1"), "t"))
+	clock.Advance(time.Hour)
+	assert.Equal(t, Limit, rules.Evaluate(request("192.0.2.1:1"), "abuser"))
+
+	// and are forgotten when the rules are next rebuilt
+	assert.NoError(t, rules.Add(Entry{Action: Exempt, TenantId: "internal"}))
+	assert.Len(t, rules.entries, 2)
+}
+
+func Test_replacing_keeps_the_old_rules_when_the_new_are_invalid(t *testing.T) {
+	rules := newRules(t, nil, Entry{Action: Deny, TenantId: "abuser"})
+
+	assert.Error(t, rules.Replace(Entry{Action: Deny, CIDR: "10.0.0.0/33"}))
+	assert.Error(t, rules.Replace(Entry{Action: Deny, TenantId: "a", CIDR: "10.0.0.0/8"}))
+	assert.Error(t, rules.Replace(Entry{Action: Limit, TenantId: "a"}))
+	assert.Equal(t, Deny, rules.Evaluate(request("192.0.2.1:1"), "abuser"))
+
+	assert.NoError(t, rules.Replace(Entry{Action: Exempt, TenantId: "abuser"}))
+	assert.Equal(t, Exempt, rules.Evaluate(request("192.0.2.1:1"), "abuser"))
+}
+
+func Test_middleware_skips_or_refuses_ahead_of_the_limiter(t *testing.T) {
+	rules := newRules(t, nil,
+		Entry{Action: Exempt, TenantId: "internal"},
+		Entry{Action: Deny, TenantId: "abuser"},
+	)
+	byHeader := func(req *http.Request) string {
+		return req.Header.Get("X-Tenant")
+	}
+	nobody := ratelimit.Middleware(refuseAll{}, byHeader, ratelimit.FixedRequestCost)
+	servlet := rules.Middleware(byHeader, nobody)(http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	}))
+	status := func(tenantId string) int {
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, request("192.0.2.1:1", "X-Tenant", tenantId))
+		return resp.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("internal"))
+	assert.Equal(t, http.StatusForbidden, status("abuser"))
+	assert.Equal(t, http.StatusTooManyRequests, status("anyone"))
+}
+
+type refuseAll struct{}
+
+func (refuseAll) AttemptAccess(userId string, requestCost uint64) bool {
+	return false
+}
@@ -0,0 +1,61 @@
+package access
+
+import (
+	"net/netip"
+	"time"
+)
+
+// A binary trie of networks, one per address family, branching on each bit of the address
+// in turn. A lookup visits at most one node per bit, however many networks there are.
+type networkTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// the verdicts of the network ending at this node, if any
+	verdicts verdicts
+}
+
+func (tree *networkTrie) root(addr netip.Addr, create bool) *trieNode {
+	root := &tree.v6
+	if addr.Is4() {
+		root = &tree.v4
+	}
+	if *root == nil && create {
+		*root = &trieNode{}
+	}
+	return *root
+}
+
+func (tree *networkTrie) insert(prefix netip.Prefix, v verdict) {
+	node := tree.root(prefix.Addr(), true)
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(bytes, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	node.verdicts = append(node.verdicts, v)
+}
+
+// the strongest verdict in force among all networks containing addr
+func (tree *networkTrie) lookup(addr netip.Addr, now time.Time) Action {
+	action := Limit
+	node := tree.root(addr, false)
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		action = max(action, node.verdicts.action(now))
+		if i == len(bytes)*8 {
+			break
+		}
+		node = node.children[bit(bytes, i)]
+	}
+	return action
+}
+
+func bit(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,156 @@
+package adaptive
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Any static limit is a guess about what the backend can sustain, and the backend's
+// capacity changes with load, deploys and its own dependencies. Rather than guess, this
+// caps the requests in flight across the whole server, and continually re-estimates
+// that cap from the latency of the requests it lets through.
+
+// What was observed of a single completed request.
+type Sample struct {
+	Latency time.Duration
+	// requests in flight, this one included, when it was admitted
+	InFlight int
+	// the request failed in a way that suggests overload, e.g. it timed out
+	Dropped bool
+}
+
+// Proposes a new limit after each sample. Called with the limiter's lock held,
+// so implementations may keep state between samples without locking of their own.
+type Algorithm interface {
+	Update(limit float64, sample Sample) float64
+}
+
+type Config struct {
+	// an AIMD with its defaults when nil
+	Algorithm    Algorithm
+	InitialLimit float64
+	// the limit never leaves [MinLimit, MaxLimit], MaxLimit of zero means no upper bound
+	MinLimit float64
+	MaxLimit float64
+}
+
+func NewLimiter(
+	config Config,
+) *adaptiveLimiter {
+	if config.Algorithm == nil {
+		config.Algorithm = &AIMD{}
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = math.Inf(1)
+	}
+	if config.MinLimit < 1 {
+		config.MinLimit = 1
+	}
+	return &adaptiveLimiter{
+		clock:  ratelimit.HardwareClock{},
+		config: &config,
+		limit:  math.Max(config.MinLimit, math.Min(config.InitialLimit, config.MaxLimit)),
+	}
+}
+
+type adaptiveLimiter struct {
+	// for testing algorithms involving time we need a mockable time source
+	clock ratelimit.Clock
+
+	config *Config
+
+	mutex    sync.Mutex
+	limit    float64
+	inFlight int
+}
+
+// Claims a slot if fewer requests than the current limit are in flight. When admitted,
+// release must be called exactly once, reporting whether the request was dropped.
+func (limiter *adaptiveLimiter) Acquire() (release func(dropped bool), ok bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if float64(limiter.inFlight) >= math.Floor(limiter.limit) {
+		return nil, false
+	}
+	limiter.inFlight++
+	inFlight := limiter.inFlight
+	started := limiter.clock.Now()
+
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			limiter.complete(Sample{
+				Latency:  limiter.clock.Now().Sub(started),
+				InFlight: inFlight,
+				Dropped:  dropped,
+			})
+		})
+	}, true
+}
+
+func (limiter *adaptiveLimiter) complete(sample Sample) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.inFlight--
+	proposed := limiter.config.Algorithm.Update(limiter.limit, sample)
+	limiter.limit = math.Max(limiter.config.MinLimit, math.Min(proposed, limiter.config.MaxLimit))
+}
+
+// The current estimate of how many requests may be in flight at once.
+func (limiter *adaptiveLimiter) Limit() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return int(limiter.limit)
+}
+
+func (limiter *adaptiveLimiter) InFlight() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.inFlight
+}
+
+// Requests beyond the limit are refused with a 503, the server is overloaded rather than
+// the tenant misbehaving. Servlets which panic or respond 503 or 504 count as dropped.
+func Middleware(
+	limiter *adaptiveLimiter,
+) func(servlet http.Handler) http.HandlerFunc {
+	return func(servlet http.Handler) http.HandlerFunc {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			release, ok := limiter.Acquire()
+			if !ok {
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				io.WriteString(resp, "Concurrency limit exceeded.")
+				return
+			}
+
+			recorder := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+			dropped := true
+			defer func() {
+				release(dropped)
+			}()
+			servlet.ServeHTTP(recorder, req)
+			dropped = recorder.status == http.StatusServiceUnavailable || recorder.status == http.StatusGatewayTimeout
+		}
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// let http.ResponseController reach Flush, Hijack and friends
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
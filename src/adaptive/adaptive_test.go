@@ -0,0 +1,115 @@
+package adaptive
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, 3, 12, 10, 10, 10, 0, time.UTC)
+
+func testLimiter(algorithm Algorithm, initial float64) (*adaptiveLimiter, *test_clocks.ManualClock) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewLimiter(Config{
+		Algorithm:    algorithm,
+		InitialLimit: initial,
+		MaxLimit:     20,
+	})
+	limiter.clock = clock
+	return limiter, clock
+}
+
+// admits n requests together, lets latency pass, then completes them all
+func serveBatch(t *testing.T, limiter *adaptiveLimiter, clock *test_clocks.ManualClock, n int, latency time.Duration, dropped bool) {
+	releases := make([]func(bool), 0, n)
+	for i := 0; i < n; i++ {
+		release, ok := limiter.Acquire()
+		assert.True(t, ok)
+		releases = append(releases, release)
+	}
+	clock.Advance(latency)
+	for _, release := range releases {
+		release(dropped)
+	}
+}
+
+func Test_aimd_grows_while_healthy_and_backs_off_on_drops(t *testing.T) {
+	limiter, clock := testLimiter(&AIMD{Timeout: 100 * time.Millisecond}, 4)
+
+	// an idle server earns no increase
+	serveBatch(t, limiter, clock, 1, 10*time.Millisecond, false)
+	assert.Equal(t, 4, limiter.Limit())
+
+	// only those admitted once at least half the limit was in use count towards growth
+	serveBatch(t, limiter, clock, 4, 10*time.Millisecond, false)
+	assert.Equal(t, 7, limiter.Limit())
+	_, ok := limiter.Acquire()
+	assert.True(t, ok)
+
+	limiter, clock = testLimiter(&AIMD{Timeout: 100 * time.Millisecond, Backoff: 0.5}, 8)
+	serveBatch(t, limiter, clock, 2, time.Second, false)
+	assert.Equal(t, 2, limiter.Limit())
+	serveBatch(t, limiter, clock, 1, 0, true)
+	assert.Equal(t, 1, limiter.Limit())
+
+	// and never below the minimum
+	serveBatch(t, limiter, clock, 1, 0, true)
+	assert.Equal(t, 1, limiter.Limit())
+}
+
+func Test_the_zero_config_limits_by_aimd(t *testing.T) {
+	limiter := NewLimiter(Config{})
+	assert.Equal(t, 1, limiter.Limit())
+
+	release, ok := limiter.Acquire()
+	assert.True(t, ok)
+	release(false)
+	assert.Equal(t, 2, limiter.Limit())
+}
+
+func Test_vegas_shrinks_as_queueing_latency_builds(t *testing.T) {
+	limiter, clock := testLimiter(&Vegas{}, 10)
+
+	serveBatch(t, limiter, clock, 10, 10*time.Millisecond, false)
+	assert.Equal(t, 16, limiter.Limit())
+
+	// at double the unloaded latency half of the limit is estimated to be queued
+	serveBatch(t, limiter, clock, 2, 20*time.Millisecond, false)
+	assert.Equal(t, 14, limiter.Limit())
+
+	// a little queueing is tolerated
+	limiter.limit = 10
+	serveBatch(t, limiter, clock, 10, 14*time.Millisecond, false)
+	assert.Equal(t, 10, limiter.Limit())
+}
+
+func Test_middleware_sheds_load_beyond_the_limit(t *testing.T) {
+	limiter, clock := testLimiter(&AIMD{}, 1)
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	limited := Middleware(limiter)(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-proceed
+		clock.Advance(time.Millisecond)
+		resp.WriteHeader(http.StatusGatewayTimeout)
+	}))
+
+	done := make(chan int)
+	go func() {
+		resp := httptest.NewRecorder()
+		limited.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+		done <- resp.Code
+	}()
+	<-entered
+
+	resp := httptest.NewRecorder()
+	limited.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+
+	close(proceed)
+	assert.Equal(t, http.StatusGatewayTimeout, <-done)
+	assert.Equal(t, 0, limiter.InFlight())
+}
@@ -0,0 +1,72 @@
+package adaptive
+
+import (
+	"math"
+	"time"
+)
+
+// Additive increase, multiplicative decrease. The limit creeps up while requests are
+// fast and the limit is actually being used, and is cut back sharply on any sign of trouble.
+type AIMD struct {
+	// added to the limit for each healthy sample, defaults to 1
+	Increase float64
+	// the limit is multiplied by this on each unhealthy sample, defaults to 0.9
+	Backoff float64
+	// samples slower than this are unhealthy, as are dropped requests
+	Timeout time.Duration
+}
+
+func (aimd *AIMD) Update(limit float64, sample Sample) float64 {
+	if sample.Dropped || (aimd.Timeout > 0 && sample.Latency > aimd.Timeout) {
+		return limit * defaultTo(aimd.Backoff, 0.9)
+	}
+	// there's no evidence a higher limit would be safe if we aren't near the current one
+	if float64(sample.InFlight)*2 < limit {
+		return limit
+	}
+	return limit + defaultTo(aimd.Increase, 1)
+}
+
+// TCP Vegas style: the lowest latency seen approximates the time to serve a request with
+// no queueing, and anything beyond it is time spent queued. From that, estimate how many
+// requests are queued rather than being served, and hold the estimate between Alpha and Beta.
+type Vegas struct {
+	// below this many estimated queued requests the limit grows, defaults to 3
+	Alpha float64
+	// above this many estimated queued requests the limit shrinks, defaults to 6
+	Beta float64
+
+	noLoadLatency time.Duration
+}
+
+func (vegas *Vegas) Update(limit float64, sample Sample) float64 {
+	if sample.Dropped {
+		return limit / 2
+	}
+	if sample.Latency <= 0 {
+		return limit
+	}
+	if vegas.noLoadLatency == 0 || sample.Latency < vegas.noLoadLatency {
+		vegas.noLoadLatency = sample.Latency
+	}
+
+	queued := math.Ceil(limit * (1 - float64(vegas.noLoadLatency)/float64(sample.Latency)))
+	switch {
+	case queued < defaultTo(vegas.Alpha, 3):
+		if float64(sample.InFlight)*2 < limit {
+			return limit
+		}
+		return limit + 1
+	case queued > defaultTo(vegas.Beta, 6):
+		return limit - 1
+	default:
+		return limit
+	}
+}
+
+func defaultTo(value float64, fallback float64) float64 {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
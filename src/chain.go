@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"fmt"
+)
+
+// A limiter consulted on behalf of some grouping of tenants, e.g. the tenant's
+// organisation, or a single key shared by everyone for a global limit.
+type Keyed struct {
+	Limiter RateLimiter
+	// derives the key charged by Limiter from the tenant identifier
+	Key func(userId string) string
+}
+
+// Charges the tenant itself.
+func SameKey(userId string) string {
+	return userId
+}
+
+// Charges a single key regardless of tenant, e.g. FixedKey("global").
+func FixedKey(key string) func(userId string) string {
+	return func(_ string) string {
+		return key
+	}
+}
+
+// Admits a request only if every limiter admits it, consulting them in order. When a
+// later limiter refuses, the cost already charged by earlier ones is refunded, so a
+// request turned away by a global limit doesn't also eat into its tenant's own quota.
+// Every limiter but the last must therefore be an AdjustableRateLimiter.
+//
+// This is best-effort rather than atomic. Charges are briefly visible to concurrent
+// requests before being refunded, so under contention a request may be refused by a
+// limiter which, in the end, it didn't exhaust.
+//
+// Priorities are passed on to whichever limiters are PriorityRateLimiters, the rest
+// ignore them.
+func Composite(limiters ...Keyed) (*chainedRateLimiter, error) {
+	for i, keyed := range limiters {
+		if _, ok := keyed.Limiter.(AdjustableRateLimiter); !ok && i < len(limiters)-1 {
+			return nil, fmt.Errorf("limiter %d of %d can't be refunded, only the last may be a plain RateLimiter", i+1, len(limiters))
+		}
+	}
+	return &chainedRateLimiter{limiters: limiters}, nil
+}
+
+// Composes limiters which all charge the tenant itself, see Composite.
+func Chain(limiters ...RateLimiter) (*chainedRateLimiter, error) {
+	keyed := make([]Keyed, len(limiters))
+	for i, limiter := range limiters {
+		keyed[i] = Keyed{Limiter: limiter, Key: SameKey}
+	}
+	return Composite(keyed...)
+}
+
+var _ DecidingRateLimiter = &chainedRateLimiter{}
+var _ AdjustableRateLimiter = &chainedRateLimiter{}
+var _ PriorityRateLimiter = &chainedRateLimiter{}
+
+type chainedRateLimiter struct {
+	limiters []Keyed
+}
+
+func (chain *chainedRateLimiter) AttemptAccess(userId string, requestCost uint64) bool {
+	return chain.Decide(userId, requestCost).Allowed
+}
+
+// The combined decision describes whichever limiter is closest to refusing the tenant.
+func (chain *chainedRateLimiter) Decide(userId string, requestCost uint64) Decision {
+	return chain.DecideWithPriority(userId, requestCost, DefaultPriority)
+}
+
+func (chain *chainedRateLimiter) DecideWithPriority(userId string, requestCost uint64, priority Priority) Decision {
+	var combined Decision
+	for i, keyed := range chain.limiters {
+		var decision Decision
+		if prioritised, ok := keyed.Limiter.(PriorityRateLimiter); ok {
+			decision = prioritised.DecideWithPriority(keyed.Key(userId), requestCost, priority)
+		} else {
+			decision = Decide(keyed.Limiter, keyed.Key(userId), requestCost)
+		}
+		if !decision.Allowed {
+			chain.adjust(chain.limiters[:i], userId, -int64(requestCost))
+			return decision
+		}
+		if i == 0 || decision.Remaining < combined.Remaining {
+			combined = decision
+		}
+	}
+	combined.Allowed = true
+	return combined
+}
+
+// Settles with every limiter in the chain.
+func (chain *chainedRateLimiter) AdjustCost(userId string, delta int64) {
+	chain.adjust(chain.limiters, userId, delta)
+}
+
+func (chain *chainedRateLimiter) adjust(limiters []Keyed, userId string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	for _, keyed := range limiters {
+		if adjustable, ok := keyed.Limiter.(AdjustableRateLimiter); ok {
+			adjustable.AdjustCost(keyed.Key(userId), delta)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// a bare bones quota, enough to observe what the composite charges
+type countingLimiter struct {
+	quota uint64
+	used  map[string]uint64
+}
+
+func newCountingLimiter(quota uint64) *countingLimiter {
+	return &countingLimiter{quota: quota, used: map[string]uint64{}}
+}
+
+func (limiter *countingLimiter) AttemptAccess(userId string, requestCost uint64) bool {
+	if limiter.used[userId]+requestCost > limiter.quota {
+		return false
+	}
+	limiter.used[userId] += requestCost
+	return true
+}
+
+func (limiter *countingLimiter) AdjustCost(userId string, delta int64) {
+	limiter.used[userId] = uint64(int64(limiter.used[userId]) + delta)
+}
+
+func organisation(userId string) string {
+	return strings.Split(userId, "/")[0]
+}
+
+func Test_composites_charge_every_key_or_none(t *testing.T) {
+	perUser := newCountingLimiter(2)
+	perOrg := newCountingLimiter(3)
+	global := newCountingLimiter(4)
+
+	limiter, err := Composite(
+		Keyed{Limiter: perUser, Key: SameKey},
+		Keyed{Limiter: perOrg, Key: organisation},
+		Keyed{Limiter: global, Key: FixedKey("global")},
+	)
+	assert.NoError(t, err)
+
+	assert.True(t, limiter.AttemptAccess("acme/alice", 1))
+	assert.True(t, limiter.AttemptAccess("acme/alice", 1))
+	// alice's own limit refuses before anything else is charged
+	assert.False(t, limiter.AttemptAccess("acme/alice", 1))
+	assert.True(t, limiter.AttemptAccess("acme/bob", 1))
+	// acme's limit refuses bob, and his own quota is refunded
+	assert.False(t, limiter.AttemptAccess("acme/bob", 1))
+	assert.Equal(t, uint64(1), perUser.used["acme/bob"])
+
+	assert.True(t, limiter.AttemptAccess("initech/carol", 1))
+	// the global limit refuses dave, and both his and initech's quotas are refunded
+	assert.False(t, limiter.AttemptAccess("initech/dave", 1))
+	assert.Equal(t, uint64(0), perUser.used["initech/dave"])
+	assert.Equal(t, uint64(1), perOrg.used["initech"])
+	assert.Equal(t, uint64(4), global.used["global"])
+}
+
+func Test_only_the_last_member_of_a_composite_may_be_unrefundable(t *testing.T) {
+	unrefundable := fixedDecisions{Decision{Allowed: true}}
+
+	_, err := Chain(unrefundable, newCountingLimiter(1))
+	assert.Error(t, err)
+	_, err = Chain(newCountingLimiter(1), unrefundable, newCountingLimiter(1))
+	assert.Error(t, err)
+	_, err = Chain(newCountingLimiter(1), unrefundable)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ClientIPConfig struct {
+	// CIDRs of the load balancers and reverse proxies in front of this server. Forwarding
+	// headers are only believed when they were added by one of these, since anyone else
+	// could have written whatever they liked into them.
+	TrustedProxies []string
+
+	// The forwarding header written by the trusted proxies, X-Forwarded-For by default.
+	// RFC 7239 Forwarded is understood, as is any header listing addresses separated by
+	// commas, e.g. X-Real-IP. Only this header is read, any others may have come straight
+	// from the client and passed through proxies which don't know to overwrite them.
+	Header string
+
+	// IPv6 clients are typically handed a whole /64, so limiting individual addresses
+	// lets them dodge the limit at will. When set, IPv6 clients are identified by the
+	// prefix of this length rather than their full address, e.g. 64.
+	IPv6PrefixLength int
+}
+
+// Identifies tenants by the IP address of the client, as opposed to the connection.
+//
+// When the connection comes from a trusted proxy, the client is taken from the proxy's
+// forwarding header, see ClientIPConfig.Header. The chain of forwarded addresses is
+// walked from the nearest hop backwards, skipping trusted proxies, and the first
+// untrusted address found is the client. Everything before it in the chain was supplied
+// by the client and is ignored. Hops which aren't addresses, such as "unknown", identify
+// nobody, so the connection's address is used instead.
+func ClientIPIdentifier(config ClientIPConfig) (func(req *http.Request) string, error) {
+	trusted := make([]netip.Prefix, 0, len(config.TrustedProxies))
+	for _, cidr := range config.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// allow bare addresses for single proxies
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	if config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", config.IPv6PrefixLength)
+	}
+
+	header := http.CanonicalHeaderKey(config.Header)
+	if header == "" {
+		header = "X-Forwarded-For"
+	}
+
+	identifier := clientIPIdentifier{trusted: trusted, header: header, ipv6PrefixLength: config.IPv6PrefixLength}
+	return identifier.identify, nil
+}
+
+type clientIPIdentifier struct {
+	trusted          []netip.Prefix
+	header           string
+	ipv6PrefixLength int
+}
+
+func (identifier clientIPIdentifier) identify(req *http.Request) string {
+	peer := stripPort(req.RemoteAddr)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return peer
+	}
+	if !identifier.isTrusted(addr) {
+		return identifier.format(addr)
+	}
+
+	hops := forwardedFor(req.Header.Values(identifier.header), identifier.header == "Forwarded")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// e.g. "unknown" or an obfuscated identifier, which every such client would share
+			return identifier.format(addr)
+		}
+		if !identifier.isTrusted(hop) || i == 0 {
+			return identifier.format(hop)
+		}
+	}
+	// no forwarding headers at all, the proxy itself is the client
+	return identifier.format(addr)
+}
+
+func (identifier clientIPIdentifier) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range identifier.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (identifier clientIPIdentifier) format(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is6() && identifier.ipv6PrefixLength > 0 {
+		prefix, _ := addr.WithZone("").Prefix(identifier.ipv6PrefixLength)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// The forwarded client addresses, furthest hop first.
+func forwardedFor(lines []string, rfc7239 bool) []string {
+	if rfc7239 {
+		return parseForwarded(lines)
+	}
+	hops := make([]string, 0, len(lines))
+	for _, line := range lines {
+		for _, hop := range strings.Split(line, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, stripPort(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// the for= parameter of each element of RFC 7239 Forwarded headers, e.g.
+// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(lines []string) []string {
+	hops := make([]string, 0, len(lines))
+	for _, line := range lines {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, stripPort(strings.Trim(value, `"`)))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// accepts "host", "host:port", "[v6]:port" and "[v6]"
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+}
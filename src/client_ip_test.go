@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func clientIP(t *testing.T, config ClientIPConfig, remoteAddr string, headers ...string) string {
+	identify, err := ClientIPIdentifier(config)
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	return identify(req)
+}
+
+var behindProxy = ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}}
+
+func Test_the_port_is_not_part_of_the_client(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", clientIP(t, ClientIPConfig{}, "192.0.2.1:54321"))
+	assert.Equal(t, "2001:db8::1", clientIP(t, ClientIPConfig{}, "[2001:db8::1]:54321"))
+	assert.Equal(t, "192.0.2.1", clientIP(t, ClientIPConfig{}, "192.0.2.1"))
+}
+
+func Test_forwarding_headers_from_untrusted_peers_are_ignored(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", clientIP(t, behindProxy, "192.0.2.1:1", "X-Forwarded-For", "198.51.100.7"))
+	assert.Equal(t, "10.0.0.1", clientIP(t, ClientIPConfig{}, "10.0.0.1:1", "X-Real-IP", "198.51.100.7"))
+}
+
+func Test_the_nearest_untrusted_hop_is_the_client(t *testing.T) {
+	// the leftmost entry was written by the client, and could be anything
+	assert.Equal(t, "198.51.100.7", clientIP(t, behindProxy, "10.0.0.1:1",
+		"X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2"))
+	// across repeated header lines too
+	assert.Equal(t, "198.51.100.7", clientIP(t, behindProxy, "10.0.0.1:1",
+		"X-Forwarded-For", "203.0.113.9",
+		"X-Forwarded-For", "198.51.100.7"))
+}
+
+func Test_a_chain_of_only_trusted_proxies_yields_the_furthest(t *testing.T) {
+	assert.Equal(t, "10.0.0.3", clientIP(t, behindProxy, "10.0.0.1:1", "X-Forwarded-For", "10.0.0.3, 10.0.0.2"))
+	assert.Equal(t, "10.0.0.1", clientIP(t, behindProxy, "10.0.0.1:1"))
+}
+
+func Test_only_the_configured_header_is_believed(t *testing.T) {
+	realIP := ClientIPConfig{TrustedProxies: behindProxy.TrustedProxies, Header: "x-real-ip"}
+	assert.Equal(t, "198.51.100.7", clientIP(t, realIP, "10.0.0.1:1",
+		"X-Real-IP", "198.51.100.7",
+		"X-Forwarded-For", "203.0.113.9"))
+	assert.Equal(t, "10.0.0.1", clientIP(t, realIP, "10.0.0.1:1", "X-Forwarded-For", "203.0.113.9"))
+}
+
+func Test_forwarded_headers_are_not_spoofable_through_x_forwarded_for_proxies(t *testing.T) {
+	// the proxy appends the client to X-Forwarded-For, passing along what the client wrote itself
+	assert.Equal(t, "198.51.100.7", clientIP(t, behindProxy, "10.0.0.1:1",
+		"Forwarded", "for=203.0.113.9",
+		"X-Forwarded-For", "198.51.100.7"))
+}
+
+func Test_rfc_7239_forwarded_is_understood(t *testing.T) {
+	rfc7239 := ClientIPConfig{TrustedProxies: behindProxy.TrustedProxies, Header: "Forwarded"}
+	assert.Equal(t, "2001:db8:cafe::17", clientIP(t, rfc7239, "10.0.0.1:1",
+		"Forwarded", `for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`,
+		"X-Forwarded-For", "198.51.100.7"))
+	assert.Equal(t, "192.0.2.60", clientIP(t, rfc7239, "10.0.0.1:1",
+		"Forwarded", `for=192.0.2.60;proto=http, for=10.0.0.9`))
+	assert.Equal(t, "10.0.0.1", clientIP(t, rfc7239, "10.0.0.1:1", "Forwarded", `for=unknown`))
+	assert.Equal(t, "10.0.0.1", clientIP(t, rfc7239, "10.0.0.1:1", "Forwarded", `for="_hidden", for=10.0.0.9`))
+}
+
+func Test_ipv4_mapped_addresses_are_ipv4(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", clientIP(t, behindProxy, "[::ffff:10.0.0.1]:1", "X-Forwarded-For", "::ffff:192.0.2.1"))
+}
+
+func Test_ipv6_clients_may_be_grouped_by_prefix(t *testing.T) {
+	grouped := ClientIPConfig{IPv6PrefixLength: 64}
+	assert.Equal(t, "2001:db8:1:2::/64", clientIP(t, grouped, "[2001:db8:1:2:aaaa::1]:1"))
+	assert.Equal(t, "2001:db8:1:2::/64", clientIP(t, grouped, "[2001:db8:1:2:bbbb::1]:1"))
+	assert.Equal(t, "192.0.2.1", clientIP(t, grouped, "192.0.2.1:1"))
+}
+
+func Test_invalid_proxies_are_reported(t *testing.T) {
+	_, err := ClientIPIdentifier(ClientIPConfig{TrustedProxies: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+	_, err = ClientIPIdentifier(ClientIPConfig{TrustedProxies: []string{"10.0.0.1"}})
+	assert.NoError(t, err)
+	_, err = ClientIPIdentifier(ClientIPConfig{IPv6PrefixLength: 129})
+	assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package concurrency
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// Rate limits bound how often a tenant may start work, but not how much of it may be
+// outstanding at once. A handful of slow requests can tie up a server just as well as
+// a flood of fast ones, so this caps the requests each tenant may have in flight.
+
+type TenantLimit struct {
+	MaxInFlight int64
+}
+
+type Config struct {
+	TenantCapacity int
+	Tenancy        func(tenant string) *TenantLimit
+
+	// the most requests in flight across all tenants, zero or less for no global limit
+	GlobalMaxInFlight int64
+}
+
+func NewLimiter(
+	config Config,
+) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		cache:  NewStringCounterCache(config.TenantCapacity),
+		config: &config,
+	}
+}
+
+type concurrencyLimiter struct {
+	// Use a fixed capacity cache to memory bound our limiter
+	// Consequence: Only the noisiest N clients will be limited, and a tenant evicted
+	// while it has requests in flight starts afresh, briefly allowing it more than its share.
+	cache StringCounterCache
+
+	global atomic.Int64
+
+	config *Config
+}
+
+type StringCounterCache interface {
+	Put(key string, value *counter) *counter
+	Get(key string) (result *counter, err error)
+}
+
+type counter struct {
+	inFlight atomic.Int64
+}
+
+type Refusal int
+
+const (
+	Admitted Refusal = iota
+	TenantLimitReached
+	GlobalLimitReached
+)
+
+// Claims an in-flight slot for the tenant. When admitted, release must be called exactly
+// once when the work is done; further calls are ignored.
+func (limiter *concurrencyLimiter) Acquire(tenantId string) (release func(), refusal Refusal) {
+	tenant, err := limiter.counter(tenantId)
+	if err != nil {
+		return nil, TenantLimitReached
+	}
+
+	if !increment(&tenant.inFlight, limiter.config.Tenancy(tenantId).MaxInFlight) {
+		return nil, TenantLimitReached
+	}
+	globalMax := limiter.config.GlobalMaxInFlight
+	if globalMax <= 0 {
+		globalMax = math.MaxInt64
+	}
+	if !increment(&limiter.global, globalMax) {
+		tenant.inFlight.Add(-1)
+		return nil, GlobalLimitReached
+	}
+
+	var released atomic.Bool
+	return func() {
+		if released.CompareAndSwap(false, true) {
+			tenant.inFlight.Add(-1)
+			limiter.global.Add(-1)
+		}
+	}, Admitted
+}
+
+// requests currently in flight across all tenants
+func (limiter *concurrencyLimiter) InFlight() int64 {
+	return limiter.global.Load()
+}
+
+func (limiter *concurrencyLimiter) counter(tenantId string) (*counter, error) {
+	tenant, err := limiter.cache.Get(tenantId)
+	if err == caches.MissingValueError {
+		tenant = &counter{}
+		limiter.cache.Put(tenantId, tenant)
+	} else if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// increments value unless it has already reached limit
+func increment(value *atomic.Int64, limit int64) bool {
+	for {
+		current := value.Load()
+		if current >= limit {
+			return false
+		}
+		if value.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// Tenants at their own limit are told to slow down with a 429, whereas reaching the
+// global limit is the server's problem rather than the tenant's and earns a 503.
+func Middleware(
+	limiter *concurrencyLimiter,
+	tenantIdentifier func(r *http.Request) string,
+) func(servlet http.Handler) http.HandlerFunc {
+	return func(servlet http.Handler) http.HandlerFunc {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			release, refusal := limiter.Acquire(tenantIdentifier(req))
+			switch refusal {
+			case Admitted:
+				// deferred so that the slot is returned even if the servlet panics
+				defer release()
+				servlet.ServeHTTP(resp, req)
+			case GlobalLimitReached:
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				io.WriteString(resp, "Concurrency limit exceeded.")
+			default:
+				resp.WriteHeader(http.StatusTooManyRequests)
+				io.WriteString(resp, "Concurrency limit exceeded.")
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package concurrency
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"sync"
+)
+
+func NewStringCounterCache(capacity int) privateStringCounterCache {
+	return WrapStringCounterCache(caches.NewLRUCache(capacity))
+}
+
+func WrapStringCounterCache(cache caches.Interface) privateStringCounterCache {
+	return privateStringCounterCache{
+		generic: cache,
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+type privateStringCounterCache struct {
+	mutex   *sync.RWMutex
+	generic caches.Interface
+}
+
+// see caches.Interface for contract
+func (cache privateStringCounterCache) Put(key string, value *counter) *counter {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	result, _ := cache.generic.Put(key, value).(*counter)
+	return result
+}
+
+// see caches.Interface for contract
+func (cache privateStringCounterCache) Get(key string) (result *counter, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	result, _ = value.(*counter)
+	return
+}
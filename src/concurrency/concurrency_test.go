@@ -0,0 +1,85 @@
+package concurrency
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func twoEach(tenant string) *TenantLimit {
+	return &TenantLimit{MaxInFlight: 2}
+}
+
+func Test_tenants_and_the_server_are_capped_independently(t *testing.T) {
+	limiter := NewLimiter(Config{
+		Tenancy:           twoEach,
+		TenantCapacity:    10,
+		GlobalMaxInFlight: 3,
+	})
+
+	first, refusal := limiter.Acquire("alice")
+	assert.Equal(t, Admitted, refusal)
+	_, refusal = limiter.Acquire("alice")
+	assert.Equal(t, Admitted, refusal)
+	_, refusal = limiter.Acquire("alice")
+	assert.Equal(t, TenantLimitReached, refusal)
+
+	_, refusal = limiter.Acquire("bob")
+	assert.Equal(t, Admitted, refusal)
+	_, refusal = limiter.Acquire("bob")
+	assert.Equal(t, GlobalLimitReached, refusal)
+	assert.Equal(t, int64(3), limiter.InFlight())
+
+	// releasing twice must not free a second slot
+	first()
+	first()
+	assert.Equal(t, int64(2), limiter.InFlight())
+	_, refusal = limiter.Acquire("bob")
+	assert.Equal(t, Admitted, refusal)
+	_, refusal = limiter.Acquire("carol")
+	assert.Equal(t, GlobalLimitReached, refusal)
+}
+
+func Test_middleware_releases_slots_even_when_servlets_panic(t *testing.T) {
+	limiter := NewLimiter(Config{Tenancy: twoEach, TenantCapacity: 10})
+
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	limited := Middleware(limiter, func(r *http.Request) string { return "tenant" })(
+		http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/panic" {
+				panic("oops")
+			}
+			entered <- struct{}{}
+			<-proceed
+			resp.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := httptest.NewRecorder()
+			limited.ServeHTTP(resp, httptest.NewRequest("GET", "/slow", nil))
+			assert.Equal(t, http.StatusOK, resp.Code)
+		}()
+		<-entered
+	}
+
+	resp := httptest.NewRecorder()
+	limited.ServeHTTP(resp, httptest.NewRequest("GET", "/slow", nil))
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+
+	close(proceed)
+	wg.Wait()
+	assert.Equal(t, int64(0), limiter.InFlight())
+
+	assert.Panics(t, func() {
+		limited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	})
+	assert.Equal(t, int64(0), limiter.InFlight())
+}
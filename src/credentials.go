@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tenant identifiers for authenticated traffic. The limiter runs before anything has
+// checked that a credential is genuine, so a client can make up as many API keys or
+// unverified tokens as they like, and with them as many tenants. TenantCapacity bounds
+// the cost of that, and JWTConfig can verify signatures so that at least tokens can't be forged.
+//
+// Tenant identifiers are cache keys, appear in logs and are echoed back in rejections,
+// so secrets are never used verbatim, only a digest of them. Each kind of identifier is
+// prefixed, e.g. "jwt:acme", so that no credential can pose as a tenant identified some
+// other way, such as a fallback's client IP.
+
+// Identifies tenants by the API key in the given header or, failing that, query parameter.
+// Either may be empty to skip it. Requests without a key are identified by fallback,
+// e.g. a ClientIPIdentifier.
+func APIKeyIdentifier(header string, queryParam string, fallback func(req *http.Request) string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		if header != "" {
+			if key := strings.TrimSpace(req.Header.Get(header)); key != "" {
+				return "apikey:" + secretDigest(key)
+			}
+		}
+		if queryParam != "" {
+			if key := req.URL.Query().Get(queryParam); key != "" {
+				return "apikey:" + secretDigest(key)
+			}
+		}
+		return fallback(req)
+	}
+}
+
+// Identifies tenants by the token in an "Authorization: Bearer" header.
+// Requests without one are identified by fallback.
+func BearerTokenIdentifier(fallback func(req *http.Request) string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		if token, ok := bearerToken(req); ok {
+			return "bearer:" + secretDigest(token)
+		}
+		return fallback(req)
+	}
+}
+
+// half of a SHA-256, plenty to tell tenants apart and useless for authenticating as them
+func secretDigest(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:16])
+}
+
+type JWTConfig struct {
+	// the claim naming the tenant, "sub" when empty
+	Claim string
+
+	// Keys to verify tokens against, without which any well formed token is believed.
+	// Once any key is given, only tokens signed by one of them with a matching
+	// algorithm (HS256/384/512 for HMAC keys, RS256/384/512 for RSA keys) are accepted.
+	HMACKeys [][]byte
+	RSAKeys  []*rsa.PublicKey
+
+	// for checking exp and nbf, the hardware clock when nil
+	Clock Clock
+}
+
+// Identifies tenants by a claim of the JWT bearer token, parsed locally without any
+// network calls. Requests without a token, or whose token is malformed, unverified,
+// expired or lacking the claim, are identified by fallback.
+func JWTIdentifier(config JWTConfig, fallback func(req *http.Request) string) func(req *http.Request) string {
+	if config.Claim == "" {
+		config.Claim = "sub"
+	}
+	if config.Clock == nil {
+		config.Clock = HardwareClock{}
+	}
+	return func(req *http.Request) string {
+		if token, ok := bearerToken(req); ok {
+			if claim, ok := config.tenant(token); ok {
+				return "jwt:" + claim
+			}
+		}
+		return fallback(req)
+	}
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func (config JWTConfig) tenant(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if !decodeSegment(parts[0], &header) {
+		return "", false
+	}
+	if !config.verify(header.Alg, parts[0]+"."+parts[1], parts[2]) {
+		return "", false
+	}
+
+	var claims map[string]any
+	if !decodeSegment(parts[1], &claims) {
+		return "", false
+	}
+	now := config.Clock.Now()
+	if exp, ok := claims["exp"].(json.Number); ok && !before(now, exp) {
+		return "", false
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok && before(now, nbf) {
+		return "", false
+	}
+
+	switch claim := claims[config.Claim].(type) {
+	case string:
+		return claim, claim != ""
+	case json.Number:
+		return claim.String(), true
+	default:
+		return "", false
+	}
+}
+
+func (config JWTConfig) verify(alg string, signed string, signature string) bool {
+	if len(config.HMACKeys) == 0 && len(config.RSAKeys) == 0 {
+		return true
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	// the algorithm is taken from the token, so check its family against the keys
+	// rather than trusting it, lest an RSA public key be used as an HMAC secret
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		newHash := map[string]func() hash.Hash{"HS256": sha256.New, "HS384": sha512.New384, "HS512": sha512.New}[alg]
+		for _, key := range config.HMACKeys {
+			mac := hmac.New(newHash, key)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		}
+	case "RS256", "RS384", "RS512":
+		digestAlg := map[string]crypto.Hash{"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512}[alg]
+		digest := digestAlg.New()
+		digest.Write([]byte(signed))
+		for _, key := range config.RSAKeys {
+			if rsa.VerifyPKCS1v15(key, digestAlg, digest.Sum(nil), sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, into any) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return false
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	return decoder.Decode(into) == nil
+}
+
+// NumericDate claims are seconds since the epoch, possibly fractional
+func before(now time.Time, date json.Number) bool {
+	seconds, err := date.Float64()
+	if err != nil {
+		return false
+	}
+	return now.Before(time.Unix(0, int64(seconds*float64(time.Second))))
+}
@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func anonymous(req *http.Request) string {
+	return "anonymous"
+}
+
+func requestWith(target string, headers ...string) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	return req
+}
+
+func segment(json string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(json))
+}
+
+func hmacToken(key []byte, header string, claims string) string {
+	signed := segment(header) + "." + segment(claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rsaToken(t *testing.T, key *rsa.PrivateKey, claims string) string {
+	signed := segment(`{"alg":"RS256"}`) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
+
+func Test_api_keys_come_from_the_header_then_the_query(t *testing.T) {
+	identify := APIKeyIdentifier("X-API-Key", "api_key", anonymous)
+
+	assert.Equal(t, "apikey:"+secretDigest("k1"), identify(requestWith("/?api_key=k2", "X-API-Key", "k1")))
+	assert.Equal(t, "apikey:"+secretDigest("k2"), identify(requestWith("/?api_key=k2")))
+	assert.Equal(t, "anonymous", identify(requestWith("/")))
+	assert.Equal(t, "anonymous", APIKeyIdentifier("X-API-Key", "", anonymous)(requestWith("/?api_key=k2")))
+}
+
+func Test_bearer_tokens_identify_tenants(t *testing.T) {
+	identify := BearerTokenIdentifier(anonymous)
+
+	assert.Equal(t, "bearer:"+secretDigest("abc"), identify(requestWith("/", bearer("abc")...)))
+	assert.Equal(t, "bearer:"+secretDigest("abc"), identify(requestWith("/", "Authorization", "bearer abc")))
+	assert.Equal(t, "anonymous", identify(requestWith("/", "Authorization", "Basic dXNlcjpwYXNz")))
+	assert.Equal(t, "anonymous", identify(requestWith("/", "Authorization", "Bearer ")))
+}
+
+func Test_secrets_are_not_used_as_tenant_ids(t *testing.T) {
+	secret := "sk_live_0123456789abcdef"
+	for _, tenantId := range []string{
+		APIKeyIdentifier("X-API-Key", "", anonymous)(requestWith("/", "X-API-Key", secret)),
+		BearerTokenIdentifier(anonymous)(requestWith("/", bearer(secret)...)),
+	} {
+		assert.NotContains(t, tenantId, secret)
+		assert.Len(t, tenantId[strings.Index(tenantId, ":")+1:], 32)
+	}
+}
+
+func Test_forged_claims_cannot_pose_as_fallback_tenants(t *testing.T) {
+	identify := JWTIdentifier(JWTConfig{}, UniqueTenantIdentifier)
+	victim := identify(requestWith("/"))
+	forged := hmacToken([]byte("anything"), `{"alg":"HS256"}`, `{"sub":"`+victim+`"}`)
+	assert.NotEqual(t, victim, identify(requestWith("/", bearer(forged)...)))
+}
+
+func Test_unverified_jwts_are_identified_by_subject(t *testing.T) {
+	identify := JWTIdentifier(JWTConfig{}, anonymous)
+	token := segment(`{"alg":"none"}`) + "." + segment(`{"sub":"acme"}`) + "."
+
+	assert.Equal(t, "jwt:acme", identify(requestWith("/", bearer(token)...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer("not.a-jwt")...)))
+}
+
+func Test_jwts_may_be_identified_by_custom_claims(t *testing.T) {
+	identify := JWTIdentifier(JWTConfig{Claim: "org_id"}, anonymous)
+	token := func(claims string) string {
+		return hmacToken([]byte("unchecked"), `{"alg":"HS256"}`, claims)
+	}
+
+	assert.Equal(t, "jwt:acme", identify(requestWith("/", bearer(token(`{"sub":"alice","org_id":"acme"}`))...)))
+	assert.Equal(t, "jwt:12345678901234567890", identify(requestWith("/", bearer(token(`{"org_id":12345678901234567890}`))...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(token(`{"sub":"alice"}`))...)))
+}
+
+func Test_hmac_signatures_are_verified(t *testing.T) {
+	key := []byte("secret")
+	identify := JWTIdentifier(JWTConfig{HMACKeys: [][]byte{[]byte("old"), key}}, anonymous)
+
+	assert.Equal(t, "jwt:acme", identify(requestWith("/", bearer(hmacToken(key, `{"alg":"HS256"}`, `{"sub":"acme"}`))...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(hmacToken([]byte("forged"), `{"alg":"HS256"}`, `{"sub":"acme"}`))...)))
+	unsigned := segment(`{"alg":"none"}`) + "." + segment(`{"sub":"acme"}`) + "."
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(unsigned)...)))
+}
+
+func Test_rsa_signatures_are_verified(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	identify := JWTIdentifier(JWTConfig{RSAKeys: []*rsa.PublicKey{&key.PublicKey}}, anonymous)
+
+	assert.Equal(t, "jwt:acme", identify(requestWith("/", bearer(rsaToken(t, key, `{"sub":"acme"}`))...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(rsaToken(t, other, `{"sub":"acme"}`))...)))
+	// an HMAC token can't be passed off as verified when only RSA keys are trusted
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(hmacToken([]byte("x"), `{"alg":"HS256"}`, `{"sub":"acme"}`))...)))
+}
+
+func Test_expired_and_premature_jwts_are_not_believed(t *testing.T) {
+	identify := JWTIdentifier(JWTConfig{Clock: test_clocks.FixedClock{T: start}}, anonymous)
+	token := func(claims string) string {
+		return hmacToken([]byte("unchecked"), `{"alg":"HS256"}`, claims)
+	}
+	now := start.Unix()
+
+	assert.Equal(t, "jwt:acme", identify(requestWith("/", bearer(token(`{"sub":"acme","exp":`+itoa(now+60)+`,"nbf":`+itoa(now-60)+`}`))...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(token(`{"sub":"acme","exp":`+itoa(now)+`}`))...)))
+	assert.Equal(t, "anonymous", identify(requestWith("/", bearer(token(`{"sub":"acme","nbf":`+itoa(now+60)+`}`))...)))
+}
+
+func itoa(seconds int64) string {
+	return strconv.FormatInt(seconds, 10)
+}
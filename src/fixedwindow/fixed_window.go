@@ -0,0 +1,180 @@
+package fixedwindow
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"sync"
+	"time"
+)
+
+// Calendar aligned quota periods, each beginning on the boundary of the tenant's local time.
+type Period int
+
+const (
+	Minute Period = iota
+	Hour
+	Day
+	Month
+)
+
+// No more than Quota units of cost per Period. Quotas do not refill gradually,
+// the whole quota becomes available again at the start of each period.
+type TenantLimit struct {
+	Quota  uint64
+	Period Period
+	// where the period boundaries fall, defaults to UTC
+	Location *time.Location
+}
+
+type Config struct {
+	TenantCapacity int
+	Tenancy        func(tenant string) *TenantLimit
+}
+
+func NewRateLimiter(
+	config Config,
+) *fixedWindowRateLimiter {
+	return &fixedWindowRateLimiter{
+		cache:  NewStringFWCBCache(config.TenantCapacity),
+		clock:  ratelimit.HardwareClock{},
+		config: &config,
+	}
+}
+
+var _ ratelimit.DecidingRateLimiter = &fixedWindowRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &fixedWindowRateLimiter{}
+
+type fixedWindowRateLimiter struct {
+	// Use a fixed capacity cache to memory bound our Rate limiter
+	// Consequence: Only the noisiest N clients will be Rate limited.
+	// Unlike the continuously refilling limiters an evicted tenant regains its whole quota,
+	// so capacity should comfortably exceed the number of tenants active in a period.
+	cache StringFWCBCache
+
+	// for testing algorithms involving time we need a mockable time source
+	clock ratelimit.Clock
+
+	config *Config
+}
+
+type StringFWCBCache interface {
+	Put(key string, value *fwcb) *fwcb
+	Get(key string) (result *fwcb, err error)
+}
+
+type fwcb struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	used        uint64
+}
+
+func (limiter *fixedWindowRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *fixedWindowRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := limiter.clock.Now()
+	tenancy := limiter.config.Tenancy(tenantId)
+	start, end := tenancy.window(now)
+	cb.rollover(start)
+
+	allowed := cb.used+accessCost <= tenancy.Quota
+	if allowed {
+		cb.used += accessCost
+	}
+
+	decision := ratelimit.Decision{
+		Allowed: allowed,
+		Limit:   tenancy.Quota,
+		Window:  end.Sub(start),
+		ResetAt: end,
+	}
+	if cb.used < tenancy.Quota {
+		decision.Remaining = tenancy.Quota - cb.used
+	}
+	if !allowed {
+		decision.RetryAfter = end.Sub(now)
+	}
+	return decision
+}
+
+// Charges or refunds the tenant's quota for the current period. Charges may exceed the quota,
+// refusing the tenant for the rest of the period, but the debt is forgiven when the next begins.
+func (limiter *fixedWindowRateLimiter) AdjustCost(tenantId string, delta int64) {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	start, _ := limiter.config.Tenancy(tenantId).window(limiter.clock.Now())
+	cb.rollover(start)
+
+	if delta >= 0 {
+		cb.used += uint64(delta)
+	} else {
+		cb.used -= min(cb.used, uint64(-delta))
+	}
+}
+
+func (limiter *fixedWindowRateLimiter) controlBlock(tenantId string) (*fwcb, error) {
+	cb, err := limiter.cache.Get(tenantId)
+	if err == caches.MissingValueError {
+		cb = &fwcb{}
+		limiter.cache.Put(tenantId, cb)
+	} else if err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// must hold the mutex
+func (cb *fwcb) rollover(windowStart time.Time) {
+	if !cb.windowStart.Equal(windowStart) {
+		cb.windowStart = windowStart
+		cb.used = 0
+	}
+}
+
+// The period containing now, as a half open interval [start, end).
+// Days and months are calendar days and months, so they may be 23 or 25 hours
+// and 28 to 31 days long as daylight saving and the calendar dictate.
+func (tenancy *TenantLimit) window(now time.Time) (start time.Time, end time.Time) {
+	location := tenancy.Location
+	if location == nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+	year, month, day := local.Date()
+
+	switch tenancy.Period {
+	case Minute:
+		start = time.Date(year, month, day, local.Hour(), local.Minute(), 0, 0, location)
+		end = time.Date(year, month, day, local.Hour(), local.Minute()+1, 0, 0, location)
+	case Hour:
+		start = time.Date(year, month, day, local.Hour(), 0, 0, 0, location)
+		end = time.Date(year, month, day, local.Hour()+1, 0, 0, 0, location)
+	case Day:
+		start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		end = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+	default:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, location)
+		end = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+	}
+
+	// a repeated hour at the end of daylight saving can normalise to the earlier occurrence
+	if !end.After(now) {
+		end = now.Add(time.Nanosecond)
+	}
+	return start, end
+}
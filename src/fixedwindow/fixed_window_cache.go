@@ -0,0 +1,40 @@
+package fixedwindow
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"sync"
+)
+
+func NewStringFWCBCache(capacity int) privateStringFWCBCache {
+	return WrapStringFWCBCache(caches.NewLRUCache(capacity))
+}
+
+func WrapStringFWCBCache(cache caches.Interface) privateStringFWCBCache {
+	return privateStringFWCBCache{
+		generic: cache,
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// genny is case-sensitive even though this has other meanings in go, so we prefix the intent.
+type privateStringFWCBCache struct {
+	mutex   *sync.RWMutex
+	generic caches.Interface
+}
+
+// see caches.Interface for contract
+func (cache privateStringFWCBCache) Put(key string, value *fwcb) *fwcb {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	result, _ := cache.generic.Put(key, value).(*fwcb)
+	return result
+}
+
+// see caches.Interface for contract
+func (cache privateStringFWCBCache) Get(key string) (result *fwcb, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	result, _ = value.(*fwcb)
+	return
+}
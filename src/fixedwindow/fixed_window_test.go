@@ -0,0 +1,77 @@
+package fixedwindow
+
+import (
+	ratelimit "github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/leakybucket"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_quotas_reset_at_the_tenants_local_calendar_boundary(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(t, err)
+
+	// 23:30 on the 31st of January in Tokyo
+	clock := &test_clocks.ManualClock{T: time.Date(2000, 1, 31, 14, 30, 0, 0, time.UTC)}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Quota: 3, Period: Month, Location: tokyo}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+
+	assert.True(t, limiter.AttemptAccess("tenant", 3))
+	decision := limiter.Decide("tenant", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 30*time.Minute, decision.RetryAfter)
+	assert.Equal(t, 31*24*time.Hour, decision.Window)
+
+	clock.Advance(30 * time.Minute)
+	decision = limiter.Decide("tenant", 1)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(2), decision.Remaining)
+	assert.Equal(t, time.Date(2000, 3, 1, 0, 0, 0, 0, tokyo), decision.ResetAt)
+}
+
+func Test_daily_quotas_follow_daylight_saving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	tenancy := TenantLimit{Quota: 1, Period: Day, Location: newYork}
+	start, end := tenancy.window(time.Date(2000, 4, 2, 12, 0, 0, 0, newYork))
+	assert.Equal(t, time.Date(2000, 4, 2, 0, 0, 0, 0, newYork), start)
+	assert.Equal(t, 23*time.Hour, end.Sub(start))
+}
+
+func Test_chained_with_a_leaky_bucket_only_charges_both_or_neither(t *testing.T) {
+	clock := test_clocks.FixedClock{T: time.Date(2000, 3, 12, 10, 10, 10, 0, time.UTC)}
+	quota := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Quota: 3, Period: Day}
+		},
+		TenantCapacity: 1,
+	})
+	quota.clock = clock
+	burst := leakybucket.NewRateLimiter(leakybucket.Config{
+		Tenancy: func(tenant string) *leakybucket.TenantLimit {
+			return &leakybucket.TenantLimit{Rate: 0, Burst: 5}
+		},
+		TenantCapacity: 1,
+	})
+
+	limiter, err := ratelimit.Chain(burst, quota)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.AttemptAccess("tenant", 1))
+	}
+	decision := limiter.Decide("tenant", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Date(2000, 3, 13, 0, 0, 0, 0, time.UTC), decision.ResetAt)
+
+	// the refused request was refunded to the burst
+	assert.True(t, burst.AttemptAccess("tenant", 2))
+	assert.False(t, burst.AttemptAccess("tenant", 1))
+}
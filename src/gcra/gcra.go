@@ -0,0 +1,163 @@
+package gcra
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// The generic cell rate algorithm tracks a single theoretical arrival time (TAT) per tenant:
+// the moment at which the tenant's quota would be fully replenished. Each access pushes the
+// TAT further into the future, and an access is refused if doing so would push it more than
+// one burst beyond the present. This is equivalent to a leaky bucket, but the state fits in
+// a single word and may be updated with compare-and-swap rather than under a mutex. The
+// cache lock is held only to find or install that word, never while it is being updated.
+
+type TenantLimit struct {
+	// units of cost replenished per second, limits of zero or less refuse all access
+	Rate  float64
+	Burst float64
+}
+
+type Config struct {
+	TenantCapacity int
+	Tenancy        func(tenant string) *TenantLimit
+}
+
+func NewRateLimiter(
+	config Config,
+) *gcraRateLimiter {
+	return &gcraRateLimiter{
+		cache:  NewStringTATCache(config.TenantCapacity),
+		clock:  ratelimit.HardwareClock{},
+		config: &config,
+	}
+}
+
+var _ ratelimit.DecidingRateLimiter = &gcraRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &gcraRateLimiter{}
+
+type gcraRateLimiter struct {
+	// Use a fixed capacity cache to memory bound our Rate limiter
+	// Consequence: Only the noisiest N clients will be Rate limited.
+	cache StringTATCache
+
+	// for testing algorithms involving time we need a mockable time source
+	clock ratelimit.Clock
+
+	config *Config
+}
+
+type StringTATCache interface {
+	Put(key string, value *tat) *tat
+	Get(key string) (result *tat, err error)
+	GetOrPut(key string, create func() *tat) (result *tat, err error)
+}
+
+// unix nanoseconds, zero meaning the quota is full
+type tat struct {
+	nanos atomic.Int64
+}
+
+func (limiter *gcraRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *gcraRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	state, err := limiter.arrivalTime(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+
+	tenancy := limiter.config.Tenancy(tenantId)
+	if tenancy.Rate <= 0 {
+		return ratelimit.Decision{Allowed: false}
+	}
+	interval := emissionInterval(tenancy)
+	tolerance := toDuration(tenancy.Burst * interval)
+	increment := toDuration(float64(accessCost) * interval)
+
+	for {
+		now := limiter.clock.Now()
+		stored := state.nanos.Load()
+		current := laterOf(stored, now)
+		next := current.Add(increment)
+
+		if allowAt := next.Add(-tolerance); now.Before(allowAt) {
+			decision := decision(now, current, tenancy, interval, tolerance)
+			if increment > tolerance {
+				// the request can never fit, the best advice we have is to wait for full quota
+				decision.RetryAfter = current.Sub(now)
+			} else {
+				decision.RetryAfter = allowAt.Sub(now)
+			}
+			return decision
+		}
+
+		if state.nanos.CompareAndSwap(stored, next.UnixNano()) {
+			decision := decision(now, next, tenancy, interval, tolerance)
+			decision.Allowed = true
+			return decision
+		} // else another access to this tenant won the race, try again against its result
+	}
+}
+
+// Settles the difference between what a request was charged and what it really cost.
+// Charges may push the TAT beyond the burst tolerance, refusing the tenant until time catches up.
+func (limiter *gcraRateLimiter) AdjustCost(tenantId string, delta int64) {
+	state, err := limiter.arrivalTime(tenantId)
+	if err != nil {
+		return
+	}
+
+	tenancy := limiter.config.Tenancy(tenantId)
+	if tenancy.Rate <= 0 {
+		return
+	}
+	adjustment := toDuration(float64(delta) * emissionInterval(tenancy))
+
+	for {
+		now := limiter.clock.Now()
+		stored := state.nanos.Load()
+		next := laterOf(stored, now).Add(adjustment)
+		if next.Before(now) {
+			// refunds can't fill the quota beyond full
+			next = now
+		}
+		if state.nanos.CompareAndSwap(stored, next.UnixNano()) {
+			return
+		}
+	}
+}
+
+func (limiter *gcraRateLimiter) arrivalTime(tenantId string) (*tat, error) {
+	return limiter.cache.GetOrPut(tenantId, func() *tat { return &tat{} })
+}
+
+func decision(now time.Time, arrival time.Time, tenancy *TenantLimit, interval float64, tolerance time.Duration) ratelimit.Decision {
+	// whatever part of the tolerance the TAT hasn't used up is available to spend
+	unused := float64(tolerance - arrival.Sub(now))
+	return ratelimit.Decision{
+		Remaining: uint64(math.Max(0, math.Floor(unused/interval))),
+		Limit:     uint64(math.Max(0, math.Floor(tenancy.Burst))),
+		Window:    tolerance,
+		ResetAt:   arrival,
+	}
+}
+
+// nanoseconds per unit of cost
+func emissionInterval(tenancy *TenantLimit) float64 {
+	return float64(time.Second) / tenancy.Rate
+}
+
+func toDuration(nanos float64) time.Duration {
+	return time.Duration(math.Ceil(nanos))
+}
+
+func laterOf(nanos int64, now time.Time) time.Time {
+	if nanos <= now.UnixNano() {
+		return now
+	}
+	return time.Unix(0, nanos).In(now.Location())
+}
@@ -0,0 +1,56 @@
+package gcra
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"sync"
+)
+
+func NewStringTATCache(capacity int) privateStringTATCache {
+	return WrapStringTATCache(caches.NewLRUCache(capacity))
+}
+
+func WrapStringTATCache(cache caches.Interface) privateStringTATCache {
+	return privateStringTATCache{
+		generic: cache,
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// The LRU bookkeeping still requires a lock on every access, but it is held only
+// for the lookup and never while the tenant's arrival time is being updated.
+type privateStringTATCache struct {
+	mutex   *sync.RWMutex
+	generic caches.Interface
+}
+
+// see caches.Interface for contract
+func (cache privateStringTATCache) Put(key string, value *tat) *tat {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	result, _ := cache.generic.Put(key, value).(*tat)
+	return result
+}
+
+// see caches.Interface for contract
+func (cache privateStringTATCache) Get(key string) (result *tat, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	result, _ = value.(*tat)
+	return
+}
+
+// Returns the cached value for key, or installs the value made by create if there is none.
+// The lookup and the insert happen under one lock, so concurrent first accesses agree.
+func (cache privateStringTATCache) GetOrPut(key string, create func() *tat) (result *tat, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	if err == caches.MissingValueError {
+		result = create()
+		cache.generic.Put(key, result)
+		return result, nil
+	}
+	result, _ = value.(*tat)
+	return
+}
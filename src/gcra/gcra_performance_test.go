@@ -0,0 +1,53 @@
+package gcra
+
+import (
+	random_strings "github.com/npxcomplete/random/src/strings"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+var thread_count = 4
+var capacity = 5
+
+func Benchmark_gcra_access_attempts_on_single_user(b *testing.B) {
+	limiter := NewRateLimiter(Config{
+		Tenancy:        uniformLimits,
+		TenantCapacity: 10,
+	})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		limiter.AttemptAccess("Dave", 1)
+	}
+}
+
+func Benchmark_gcra_parallel_access(b *testing.B) {
+	limiter := NewRateLimiter(Config{
+		Tenancy:        uniformLimits,
+		TenantCapacity: 10,
+	})
+
+	gen := random_strings.ByteStringGenerator{
+		Alphabet:  random_strings.EnglishAlphabet,
+		RandomGen: rand.New(rand.NewSource(0)),
+	}
+
+	keys := make([]string, capacity*2)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = gen.String(12)
+	}
+
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for t := 0; t < thread_count; t++ {
+		wg.Add(1)
+		go func() {
+			for i := 0; i < b.N; i++ {
+				limiter.AttemptAccess(keys[rand.Int31n(int32(len(keys)))], 1)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package gcra
+
+import (
+	"bytes"
+	ratelimit "github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, 3, 12, 10, 10, 10, 0, time.UTC)
+
+var uniformLimit = TenantLimit{
+	Rate:  100,
+	Burst: 100,
+}
+
+func uniformLimits(tenant string) *TenantLimit {
+	return &uniformLimit
+}
+
+func Test_smoke_test_happy_path_with_http(t *testing.T) {
+	config := Config{
+		Tenancy:        uniformLimits,
+		TenantCapacity: 1,
+	}
+	limiter := NewRateLimiter(config)
+	limiter.clock = test_clocks.FixedClock{T: start}
+
+	limitedServlet := ratelimit.StdMiddleware(limiter)(
+		http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+			resp.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	req := httptest.NewRequest("GET", "/path/to/resource", &bytes.Buffer{})
+	req.RemoteAddr = "255.255.255.255"
+
+	for i := 0; i < int(config.Tenancy(req.RemoteAddr).Burst); i++ {
+		resp := httptest.NewRecorder()
+		limitedServlet.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+
+	resp := httptest.NewRecorder()
+	limitedServlet.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+}
+
+func Test_decisions_match_the_equivalent_leaky_bucket(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 2, Burst: 4}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+
+	decision := limiter.Decide("tenant", 3)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(1), decision.Remaining)
+	assert.Equal(t, uint64(4), decision.Limit)
+	assert.Equal(t, 2*time.Second, decision.Window)
+	assert.Equal(t, start.Add(1500*time.Millisecond), decision.ResetAt)
+
+	decision = limiter.Decide("tenant", 2)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, uint64(1), decision.Remaining)
+	assert.Equal(t, 500*time.Millisecond, decision.RetryAfter)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, limiter.AttemptAccess("tenant", 2))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_adjustments_charge_into_debt_and_refund_up_to_full(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 2}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+
+	limiter.AdjustCost("tenant", 4)
+	clock.Advance(2 * time.Second)
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+	clock.Advance(time.Second)
+	assert.True(t, limiter.AttemptAccess("tenant", 1))
+
+	limiter.AdjustCost("tenant", -10)
+	assert.True(t, limiter.AttemptAccess("tenant", 2))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_concurrent_access_never_exceeds_the_burst(t *testing.T) {
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 100}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = test_clocks.FixedClock{T: start}
+
+	var wg sync.WaitGroup
+	var granted = make(chan struct{}, 1000)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if limiter.AttemptAccess("tenant", 1) {
+					granted <- struct{}{}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, len(granted))
+}
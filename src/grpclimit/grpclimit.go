@@ -0,0 +1,174 @@
+package grpclimit
+
+import (
+	"context"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"math"
+	"net"
+	"strconv"
+)
+
+// The gRPC counterpart of ratelimit.Middleware's arguments.
+type Config struct {
+	// PeerAddress when nil
+	TenantIdentifier func(ctx context.Context, fullMethod string) string
+	// the up front cost of a call, by its full method name, e.g. "/pkg.Service/Method", 1 when nil
+	CostOfCall func(fullMethod string) uint64
+	// the cost of each message sent or received on a stream, messages are free when nil
+	CostOfMessage func(fullMethod string) uint64
+}
+
+// Identifies tenants by the IP address of their connection.
+func PeerAddress(ctx context.Context, _ string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Identifies tenants by the first value of the given incoming metadata key, or failing that by fallback.
+//
+// Metadata is whatever the client chose to send, so a client can claim to be any tenant it
+// likes, or a new one on every call. Only rely on keys written by something trusted, e.g. a
+// proxy which overwrites the client's own, and otherwise identify tenants by whatever
+// authentication has established, such as the subject of a verified client certificate.
+func MetadataIdentifier(key string, fallback func(ctx context.Context, fullMethod string) string) func(ctx context.Context, fullMethod string) string {
+	return func(ctx context.Context, fullMethod string) string {
+		if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+		return fallback(ctx, fullMethod)
+	}
+}
+
+// Costs methods by their full name, those not listed costing fallback.
+func MethodCosts(costs map[string]uint64, fallback uint64) func(fullMethod string) uint64 {
+	return func(fullMethod string) uint64 {
+		if cost, ok := costs[fullMethod]; ok {
+			return cost
+		}
+		return fallback
+	}
+}
+
+// Refused calls fail with codes.ResourceExhausted, carrying an errdetails.RetryInfo and
+// retry-after (in whole seconds) and ratelimit-limit/ratelimit-remaining trailers.
+func UnaryServerInterceptor(limiter ratelimit.RateLimiter, config Config) grpc.UnaryServerInterceptor {
+	config = config.withDefaults()
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		tenantId := config.TenantIdentifier(ctx, info.FullMethod)
+		decision := ratelimit.Decide(limiter, tenantId, config.CostOfCall(info.FullMethod))
+		if !decision.Allowed {
+			grpc.SetTrailer(ctx, trailer(decision))
+			return nil, exhausted(decision)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// As UnaryServerInterceptor, for streams. Each message is charged as it passes, and a
+// tenant who runs out mid-stream has the stream ended with codes.ResourceExhausted.
+func StreamServerInterceptor(limiter ratelimit.RateLimiter, config Config) grpc.StreamServerInterceptor {
+	config = config.withDefaults()
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		tenantId := config.TenantIdentifier(stream.Context(), info.FullMethod)
+		decision := ratelimit.Decide(limiter, tenantId, config.CostOfCall(info.FullMethod))
+		if !decision.Allowed {
+			stream.SetTrailer(trailer(decision))
+			return exhausted(decision)
+		}
+		if config.CostOfMessage == nil {
+			return handler(srv, stream)
+		}
+		return handler(srv, &meteredStream{
+			ServerStream: stream,
+			limiter:      limiter,
+			tenantId:     tenantId,
+			cost:         config.CostOfMessage(info.FullMethod),
+		})
+	}
+}
+
+func (config Config) withDefaults() Config {
+	if config.TenantIdentifier == nil {
+		config.TenantIdentifier = PeerAddress
+	}
+	if config.CostOfCall == nil {
+		config.CostOfCall = func(string) uint64 {
+			return 1
+		}
+	}
+	return config
+}
+
+type meteredStream struct {
+	grpc.ServerStream
+	limiter  ratelimit.RateLimiter
+	tenantId string
+	cost     uint64
+}
+
+// Charged up front as SendMsg is, so a refused message is left unread. Reads which turn up
+// no message, e.g. the io.EOF ending the stream, are refunded if the limiter allows it.
+func (stream *meteredStream) RecvMsg(m any) error {
+	if err := stream.charge(); err != nil {
+		return err
+	}
+	err := stream.ServerStream.RecvMsg(m)
+	if adjustable, ok := stream.limiter.(ratelimit.AdjustableRateLimiter); ok && err != nil {
+		adjustable.AdjustCost(stream.tenantId, -int64(stream.cost))
+	}
+	return err
+}
+
+func (stream *meteredStream) SendMsg(m any) error {
+	if err := stream.charge(); err != nil {
+		return err
+	}
+	return stream.ServerStream.SendMsg(m)
+}
+
+func (stream *meteredStream) charge() error {
+	decision := ratelimit.Decide(stream.limiter, stream.tenantId, stream.cost)
+	if decision.Allowed {
+		return nil
+	}
+	stream.SetTrailer(trailer(decision))
+	return exhausted(decision)
+}
+
+func exhausted(decision ratelimit.Decision) error {
+	refusal := status.New(codes.ResourceExhausted, "Throttle limit exceeded.")
+	if decision.RetryAfter > 0 {
+		if detailed, err := refusal.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(decision.RetryAfter)}); err == nil {
+			refusal = detailed
+		}
+	}
+	return refusal.Err()
+}
+
+// ratelimit headers, as far as gRPC metadata allows
+func trailer(decision ratelimit.Decision) metadata.MD {
+	md := metadata.MD{}
+	if decision.RetryAfter > 0 {
+		md.Set("retry-after", strconv.FormatInt(int64(math.Ceil(decision.RetryAfter.Seconds())), 10))
+	}
+	// limiters that can't explain themselves leave us nothing more to say
+	if !decision.ResetAt.IsZero() {
+		md.Set("ratelimit-limit", strconv.FormatUint(decision.Limit, 10))
+		md.Set("ratelimit-remaining", strconv.FormatUint(decision.Remaining, 10))
+	}
+	return md
+}
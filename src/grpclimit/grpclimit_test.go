@@ -0,0 +1,177 @@
+package grpclimit
+
+import (
+	"context"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/leakybucket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const check = "/grpc.health.v1.Health/Check"
+
+// a limiter with a burst of four which never refills, behind an in-process health service
+func dial(t *testing.T, config Config) healthpb.HealthClient {
+	limiter := leakybucket.NewRateLimiter(leakybucket.Config{
+		Tenancy: func(tenant string) *leakybucket.TenantLimit {
+			return &leakybucket.TenantLimit{Rate: 0, Burst: 4}
+		},
+		TenantCapacity: 10,
+	})
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(limiter, config)),
+		grpc.StreamInterceptor(StreamServerInterceptor(limiter, config)),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func asTenant(tenantId string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-tenant", tenantId)
+}
+
+var byMetadata = Config{
+	TenantIdentifier: MetadataIdentifier("x-tenant", PeerAddress),
+	CostOfCall:       MethodCosts(map[string]uint64{check: 2}, 1),
+}
+
+func Test_unary_calls_are_charged_by_method(t *testing.T) {
+	client := dial(t, byMetadata)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Check(asTenant("acme"), &healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+	}
+
+	var trailer metadata.MD
+	_, err := client.Check(asTenant("acme"), &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"4"}, trailer.Get("ratelimit-limit"))
+	assert.Equal(t, []string{"0"}, trailer.Get("ratelimit-remaining"))
+
+	// other tenants have their own buckets
+	_, err = client.Check(asTenant("other"), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+}
+
+// a limiter which always decides the same way
+type fixedDecision struct {
+	decision ratelimit.Decision
+}
+
+func (limiter fixedDecision) AttemptAccess(tenantId string, cost uint64) bool {
+	return limiter.decision.Allowed
+}
+
+func (limiter fixedDecision) Decide(tenantId string, cost uint64) ratelimit.Decision {
+	return limiter.decision
+}
+
+func Test_refusals_carry_retry_info(t *testing.T) {
+	limiter := fixedDecision{ratelimit.Decision{Allowed: false, RetryAfter: 2 * time.Second}}
+	interceptor := UnaryServerInterceptor(limiter, Config{TenantIdentifier: func(context.Context, string) string { return "t" }})
+	info := &grpc.UnaryServerInfo{FullMethod: check}
+	ok := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+
+	_, err := interceptor(context.Background(), nil, info, ok)
+	refusal := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, refusal.Code())
+	assert.Len(t, refusal.Details(), 1)
+	retry, _ := refusal.Details()[0].(*errdetails.RetryInfo)
+	assert.Equal(t, 2*time.Second, retry.GetRetryDelay().AsDuration())
+}
+
+// a stream with messages to read, for as long as they last
+type inbox struct {
+	grpc.ServerStream
+	unread int
+}
+
+func (stream *inbox) Context() context.Context {
+	return context.Background()
+}
+
+func (stream *inbox) SetTrailer(metadata.MD) {}
+
+func (stream *inbox) RecvMsg(m any) error {
+	if stream.unread == 0 {
+		return io.EOF
+	}
+	stream.unread--
+	return nil
+}
+
+func Test_messages_are_charged_before_they_are_read(t *testing.T) {
+	limiter := leakybucket.NewRateLimiter(leakybucket.Config{
+		Tenancy: func(tenant string) *leakybucket.TenantLimit {
+			return &leakybucket.TenantLimit{Rate: 0, Burst: 2}
+		},
+		TenantCapacity: 10,
+	})
+	received := &inbox{unread: 1}
+	stream := &meteredStream{ServerStream: received, limiter: limiter, tenantId: "t", cost: 1}
+
+	// reaching the end of the stream costs nothing
+	assert.NoError(t, stream.RecvMsg(nil))
+	assert.Equal(t, io.EOF, stream.RecvMsg(nil))
+
+	// while a refused message stays unread
+	received.unread = 2
+	assert.NoError(t, stream.RecvMsg(nil))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(stream.RecvMsg(nil)))
+	assert.Equal(t, 1, received.unread)
+}
+
+func Test_streams_are_charged_per_message(t *testing.T) {
+	config := byMetadata
+	config.CostOfMessage = func(string) uint64 { return 1 }
+	client := dial(t, config)
+
+	// one for the call, one for the request received, one for each status sent
+	stream, err := client.Watch(asTenant("acme"), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	stream, err = client.Watch(asTenant("acme"), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"0"}, stream.Trailer().Get("ratelimit-remaining"))
+}
+
+func Test_tenants_default_to_their_peer_address(t *testing.T) {
+	client := dial(t, Config{})
+
+	for i := 0; i < 4; i++ {
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+	}
+	_, err := client.Check(asTenant("ignored"), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type HeaderStyle int
+
+const (
+	// Only rejected responses are annotated, and only with Retry-After.
+	RetryAfterOnly HeaderStyle = iota
+
+	// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (unix epoch seconds),
+	// as popularised by GitHub and friends.
+	LegacyHeaders
+
+	// RateLimit-Policy and RateLimit structured fields per draft-ietf-httpapi-ratelimit-headers.
+	IETFHeaders
+)
+
+// the IETF fields name the policy a quota belongs to, we only ever apply one per middleware
+const defaultPolicyName = `"default"`
+
+func (style HeaderStyle) write(header http.Header, decision Decision, now time.Time) {
+	if !decision.Allowed && decision.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.FormatInt(wholeSeconds(decision.RetryAfter), 10))
+	}
+
+	// limiters that can't explain themselves leave us nothing more to say
+	if decision.ResetAt.IsZero() {
+		return
+	}
+
+	switch style {
+	case LegacyHeaders:
+		header.Set("X-RateLimit-Limit", strconv.FormatUint(decision.Limit, 10))
+		header.Set("X-RateLimit-Remaining", strconv.FormatUint(decision.Remaining, 10))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Add(time.Second-1).Unix(), 10))
+	case IETFHeaders:
+		header.Set("RateLimit-Policy", fmt.Sprintf(
+			"%s;q=%d;w=%d", defaultPolicyName, decision.Limit, wholeSeconds(decision.Window),
+		))
+		header.Set("RateLimit", fmt.Sprintf(
+			"%s;r=%d;t=%d", defaultPolicyName, decision.Remaining, wholeSeconds(decision.ResetAt.Sub(now)),
+		))
+	}
+}
+
+// header values are delta-seconds, rounding down would invite clients to retry too early
+func wholeSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
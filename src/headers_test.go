@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, 3, 12, 10, 10, 10, 0, time.UTC)
+
+type fixedDecisions struct {
+	decision Decision
+}
+
+func (limiter fixedDecisions) AttemptAccess(userId string, requestCost uint64) bool {
+	return limiter.decision.Allowed
+}
+
+func (limiter fixedDecisions) Decide(userId string, requestCost uint64) Decision {
+	return limiter.decision
+}
+
+func okServlet(resp http.ResponseWriter, _ *http.Request) {
+	resp.WriteHeader(http.StatusOK)
+}
+
+func serve(limiter RateLimiter, options ...MiddlewareOption) *httptest.ResponseRecorder {
+	servlet := Middleware(limiter, UniqueTenantIdentifier, FixedRequestCost, options...)(http.HandlerFunc(okServlet))
+	resp := httptest.NewRecorder()
+	servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	return resp
+}
+
+func Test_rejections_carry_retry_after_by_default(t *testing.T) {
+	resp := serve(fixedDecisions{Decision{
+		Allowed:    false,
+		Limit:      10,
+		ResetAt:    start.Add(10 * time.Second),
+		RetryAfter: 1500 * time.Millisecond,
+	}})
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+	assert.Empty(t, resp.Header().Get("X-RateLimit-Limit"))
+	assert.Empty(t, resp.Header().Get("RateLimit"))
+}
+
+func Test_legacy_headers_on_allowed_responses(t *testing.T) {
+	resp := serve(fixedDecisions{Decision{
+		Allowed:   true,
+		Remaining: 7,
+		Limit:     10,
+		Window:    10 * time.Second,
+		ResetAt:   start.Add(2500 * time.Millisecond),
+	}}, WithHeaders(LegacyHeaders))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "7", resp.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "952855813", resp.Header().Get("X-RateLimit-Reset"))
+	assert.Empty(t, resp.Header().Get("Retry-After"))
+}
+
+func Test_ietf_headers_on_rejected_responses(t *testing.T) {
+	resp := serve(fixedDecisions{Decision{
+		Allowed:    false,
+		Remaining:  0,
+		Limit:      10,
+		Window:     10 * time.Second,
+		ResetAt:    start.Add(10 * time.Second),
+		RetryAfter: time.Second,
+	}}, WithHeaders(IETFHeaders), WithClock(test_clocks.FixedClock{T: start}))
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+	assert.Equal(t, `"default";q=10;w=10`, resp.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, `"default";r=0;t=10`, resp.Header().Get("RateLimit"))
+}
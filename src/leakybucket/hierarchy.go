@@ -0,0 +1,209 @@
+package leakybucket
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+	"sort"
+	"time"
+)
+
+// guards against Tenancy describing an absurdly deep tree, cycles are cut short regardless
+const maxHierarchyDepth = 16
+
+// Each tenant spends from its own bucket first, and once that runs dry borrows the
+// shortfall from its parent, then its grandparent and so on, as named by TenantLimit.Parent.
+// An org's pool thereby soaks up bursts from whichever of its teams needs it most,
+// while quiet teams keep their own capacity to themselves.
+//
+// Every tenant in the tree, parents included, occupies a slot in the cache.
+func NewHierarchicalRateLimiter(
+	config Config,
+) *hierarchicalRateLimiter {
+	return &hierarchicalRateLimiter{
+		buckets: NewRateLimiter(config),
+	}
+}
+
+var _ ratelimit.DecidingRateLimiter = &hierarchicalRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &hierarchicalRateLimiter{}
+
+type hierarchicalRateLimiter struct {
+	buckets *leakyBucketRateLimiter
+}
+
+// a bucket in a tenant's lineage, along with the limits it was refilled under
+type member struct {
+	tenantId string
+	cb       *lbcb
+	tenancy  *TenantLimit
+}
+
+func (limiter *hierarchicalRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *hierarchicalRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	lineage, err := limiter.lineage(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+	unlock := lock(lineage)
+	defer unlock()
+
+	now := limiter.buckets.clock.Now()
+	for _, bucket := range lineage {
+		bucket.cb.refill(now, bucket.tenancy)
+	}
+
+	cost := leakyBucketAccessCost(accessCost)
+	allowed := cost <= available(lineage)
+	if allowed {
+		for _, bucket := range lineage {
+			taken := math.Min(cost, math.Max(0, bucket.cb.availableCapacity))
+			bucket.cb.availableCapacity -= taken
+			cost -= taken
+		}
+	}
+
+	burst := 0.0
+	fullAt := now
+	for _, bucket := range lineage {
+		burst += bucket.tenancy.Burst
+		full := now.Add(timeToRefill(bucket.tenancy.Burst-bucket.cb.availableCapacity, bucket.tenancy.Rate))
+		if full.After(fullAt) {
+			fullAt = full
+		}
+	}
+
+	decision := ratelimit.Decision{
+		Allowed:   allowed,
+		Remaining: uint64(math.Max(0, math.Floor(available(lineage)))),
+		Limit:     uint64(math.Max(0, math.Floor(burst))),
+		Window:    timeToRefill(lineage[0].tenancy.Burst, lineage[0].tenancy.Rate),
+		ResetAt:   fullAt,
+	}
+	if !allowed {
+		decision.RetryAfter = timeToAccumulate(lineage, leakyBucketAccessCost(accessCost))
+	}
+	return decision
+}
+
+// Charges land on the tenant's own bucket, possibly driving it into debt. Refunds fill
+// the tenant's own bucket first, and whatever doesn't fit is returned up the tree.
+func (limiter *hierarchicalRateLimiter) AdjustCost(tenantId string, delta int64) {
+	lineage, err := limiter.lineage(tenantId)
+	if err != nil {
+		return
+	}
+	unlock := lock(lineage)
+	defer unlock()
+
+	now := limiter.buckets.clock.Now()
+	if delta >= 0 {
+		lineage[0].cb.refill(now, lineage[0].tenancy)
+		lineage[0].cb.availableCapacity -= leakyBucketAccessCost(delta)
+		return
+	}
+
+	refund := leakyBucketAccessCost(-delta)
+	for _, bucket := range lineage {
+		bucket.cb.refill(now, bucket.tenancy)
+		returned := math.Min(refund, math.Max(0, bucket.tenancy.Burst-bucket.cb.availableCapacity))
+		bucket.cb.availableCapacity += returned
+		refund -= returned
+	}
+}
+
+// the tenant's bucket followed by each of its ancestors'
+func (limiter *hierarchicalRateLimiter) lineage(tenantId string) ([]member, error) {
+	lineage := make([]member, 0, 4)
+	visited := make(map[string]bool, 4)
+	for id := tenantId; len(lineage) < maxHierarchyDepth && !visited[id]; {
+		visited[id] = true
+		cb, err := limiter.buckets.controlBlock(id)
+		if err != nil {
+			return nil, err
+		}
+		tenancy := limiter.buckets.config().Tenancy(id)
+		lineage = append(lineage, member{tenantId: id, cb: cb, tenancy: tenancy})
+
+		if tenancy.Parent == "" {
+			break
+		}
+		id = tenancy.Parent
+	}
+	return lineage, nil
+}
+
+// Locks are always taken in order of tenant ID rather than along the lineage. Lineages
+// needn't agree on which of two tenants is the ancestor, whether because Tenancy describes
+// a cycle or because UpdateLimits moved a tenant mid-request, and locking along them
+// would let two requests each hold the bucket the other is waiting on.
+func lock(lineage []member) (unlock func()) {
+	ordered := lockOrder(lineage)
+	for _, bucket := range ordered {
+		bucket.cb.mutex.Lock()
+	}
+	return func() {
+		for i := len(ordered) - 1; i >= 0; i-- {
+			ordered[i].cb.mutex.Unlock()
+		}
+	}
+}
+
+func lockOrder(lineage []member) []member {
+	ordered := make([]member, len(lineage))
+	copy(ordered, lineage)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].tenantId < ordered[j].tenantId })
+	return ordered
+}
+
+func available(lineage []member) leakyBucketAccessCost {
+	total := 0.0
+	for _, bucket := range lineage {
+		total += math.Max(0, bucket.cb.availableCapacity)
+	}
+	return total
+}
+
+// How long until the lineage as a whole has accessCost available. Each bucket refills
+// linearly until it is full, so the total is piecewise linear with a corner wherever
+// a bucket starts or stops filling; walk the corners in order until the total is enough.
+func timeToAccumulate(lineage []member, accessCost leakyBucketAccessCost) time.Duration {
+	type corner struct {
+		// seconds from now, and the change in the lineage's combined refill rate
+		at     float64
+		change float64
+	}
+
+	corners := make([]corner, 0, 2*len(lineage))
+	total := 0.0
+	for _, bucket := range lineage {
+		rate, burst, current := bucket.tenancy.Rate, bucket.tenancy.Burst, bucket.cb.availableCapacity
+		total += math.Max(0, current)
+		if rate <= 0 || current >= burst {
+			continue
+		}
+		// buckets in debt must repay it before they contribute anything
+		corners = append(corners,
+			corner{at: math.Max(0, -current/rate), change: rate},
+			corner{at: (burst - current) / rate, change: -rate},
+		)
+	}
+	sort.Slice(corners, func(i, j int) bool { return corners[i].at < corners[j].at })
+
+	elapsed := 0.0
+	rate := 0.0
+	for _, c := range corners {
+		if rate > 0 && total+rate*(c.at-elapsed) >= accessCost {
+			break
+		}
+		total += rate * (c.at - elapsed)
+		elapsed = c.at
+		rate += c.change
+	}
+	if total < accessCost && rate > 0 {
+		elapsed += (accessCost - total) / rate
+	} // else more than the whole tree can ever hold, the best advice we have is to wait for it to fill
+	return time.Duration(math.Ceil(elapsed * float64(time.Second)))
+}
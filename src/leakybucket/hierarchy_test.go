@@ -0,0 +1,117 @@
+package leakybucket
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// an org with two teams, and a key belonging to one of them
+var orgChart = map[string]*TenantLimit{
+	"acme":          {Rate: 1, Burst: 10},
+	"acme/red":      {Rate: 1, Burst: 2, Parent: "acme"},
+	"acme/blue":     {Rate: 1, Burst: 2, Parent: "acme"},
+	"acme/blue/key": {Rate: 1, Burst: 1, Parent: "acme/blue"},
+}
+
+func hierarchicalLimiter() (*hierarchicalRateLimiter, *test_clocks.ManualClock) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewHierarchicalRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return orgChart[tenant]
+		},
+		TenantCapacity: 10,
+	})
+	limiter.buckets.clock = clock
+	return limiter, clock
+}
+
+func Test_children_borrow_from_their_ancestors_once_dry(t *testing.T) {
+	limiter, _ := hierarchicalLimiter()
+
+	decision := limiter.Decide("acme/blue/key", 5)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(13-5), decision.Remaining)
+	assert.Equal(t, uint64(13), decision.Limit)
+
+	// blue's own bucket was emptied before acme's was touched
+	assert.False(t, limiter.AttemptAccess("acme/blue", 9))
+	assert.True(t, limiter.AttemptAccess("acme/blue", 8))
+
+	// red still has its own two, but the org pool is spent
+	assert.True(t, limiter.AttemptAccess("acme/red", 2))
+	assert.False(t, limiter.AttemptAccess("acme/red", 1))
+}
+
+func Test_retry_after_accounts_for_every_bucket_refilling(t *testing.T) {
+	limiter, clock := hierarchicalLimiter()
+	assert.True(t, limiter.AttemptAccess("acme/blue/key", 13))
+
+	// three buckets refilling at a unit per second each, until the key's fills after one second
+	decision := limiter.Decide("acme/blue/key", 4)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 1500*time.Millisecond, decision.RetryAfter)
+
+	clock.Advance(1499 * time.Millisecond)
+	assert.False(t, limiter.AttemptAccess("acme/blue/key", 4))
+	clock.Advance(time.Millisecond)
+	assert.True(t, limiter.AttemptAccess("acme/blue/key", 4))
+}
+
+func Test_refunds_return_up_the_tree(t *testing.T) {
+	limiter, _ := hierarchicalLimiter()
+	assert.True(t, limiter.AttemptAccess("acme/red", 12))
+
+	limiter.AdjustCost("acme/red", -5)
+	assert.True(t, limiter.AttemptAccess("acme", 3))
+	assert.False(t, limiter.AttemptAccess("acme", 1))
+	assert.True(t, limiter.AttemptAccess("acme/red", 2))
+}
+
+func Test_cyclic_hierarchies_are_cut_short(t *testing.T) {
+	limiter := NewHierarchicalRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			if tenant == "a" {
+				return &TenantLimit{Rate: 1, Burst: 1, Parent: "b"}
+			}
+			return &TenantLimit{Rate: 1, Burst: 1, Parent: "a"}
+		},
+		TenantCapacity: 10,
+	})
+	limiter.buckets.clock = test_clocks.FixedClock{T: start}
+
+	assert.True(t, limiter.AttemptAccess("a", 2))
+	assert.False(t, limiter.AttemptAccess("b", 1))
+}
+
+func Test_cyclic_hierarchies_lock_in_the_same_order(t *testing.T) {
+	limiter := NewHierarchicalRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			if tenant == "a" {
+				return &TenantLimit{Rate: 1, Burst: 1, Parent: "b"}
+			}
+			return &TenantLimit{Rate: 1, Burst: 1, Parent: "a"}
+		},
+		TenantCapacity: 10,
+	})
+	fromA, err := limiter.lineage("a")
+	assert.NoError(t, err)
+	fromB, err := limiter.lineage("b")
+	assert.NoError(t, err)
+
+	// each lineage has the other's ancestor as its child, and locking along them could deadlock
+	assert.Equal(t, []string{"a", "b"}, tenantIds(fromA))
+	assert.Equal(t, []string{"b", "a"}, tenantIds(fromB))
+	assert.Equal(t, []string{"a", "b"}, tenantIds(lockOrder(fromA)))
+	assert.Equal(t, []string{"a", "b"}, tenantIds(lockOrder(fromB)))
+	assert.True(t, lockOrder(fromA)[0].cb == lockOrder(fromB)[0].cb)
+}
+
+func tenantIds(lineage []member) []string {
+	ids := make([]string, 0, len(lineage))
+	for _, bucket := range lineage {
+		ids = append(ids, bucket.tenantId)
+	}
+	return ids
+}
@@ -5,12 +5,16 @@ import (
 	"github.com/npxcomplete/http-rate-limit/src"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TenantLimit struct {
 	Rate           float64
 	Burst          float64
+	// Optional, and only consulted by the hierarchical limiter: the tenant whose
+	// bucket may be borrowed from once this one runs dry.
+	Parent string
 }
 
 type Config struct {
@@ -21,31 +25,72 @@ type Config struct {
 func NewRateLimiter(
 	config Config,
 ) *leakyBucketRateLimiter {
-	return &leakyBucketRateLimiter{
-		cache:  NewStringLBCBCache(config.TenantCapacity),
-		clock:  ratelimit.HardwareClock{},
-		log:    ratelimit.StdOutLogger{},
-		config: &config,
+	limiter := &leakyBucketRateLimiter{
+		cache: NewStringLBCBCache(config.TenantCapacity),
+		clock: ratelimit.HardwareClock{},
+		after: time.After,
+		log:   ratelimit.StdOutLogger{},
 	}
+	limiter.settings.Store(&config)
+	return limiter
 }
 
+// Swaps in new limits for every tenant without disturbing their buckets. Each bucket
+// adopts its tenant's new limits on its next access, keeping the capacity the tenant
+// has already used: a tenant who has used 30 of a 100 burst has 70 left, and 170
+// left if their burst is raised to 200, or 20 if it is cut to 50.
+func (limiter *leakyBucketRateLimiter) UpdateLimits(tenancy func(tenant string) *TenantLimit) {
+	config := *limiter.config()
+	config.Tenancy = tenancy
+	limiter.settings.Store(&config)
+}
+
+func (limiter *leakyBucketRateLimiter) config() *Config {
+	return limiter.settings.Load()
+}
+
+var _ ratelimit.DecidingRateLimiter = &leakyBucketRateLimiter{}
+
 func (limiter *leakyBucketRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
-	var err error
-	var cb *lbcb
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *leakyBucketRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+
+	return cb.accessAttempt(tenantId, limiter.clock, limiter.config(), leakyBucketAccessCost(accessCost), 0)
+}
+
+var _ ratelimit.AdjustableRateLimiter = &leakyBucketRateLimiter{}
+
+// Settles the difference between what a request was charged and what it really cost.
+// The bucket may go into debt, in which case the tenant is refused until refills repay it.
+func (limiter *leakyBucketRateLimiter) AdjustCost(tenantId string, delta int64) {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return
+	}
+	cb.charge(tenantId, limiter.clock, limiter.config(), leakyBucketAccessCost(delta))
+}
 
-	cb, err = limiter.cache.Get(tenantId)
+func (limiter *leakyBucketRateLimiter) controlBlock(tenantId string) (*lbcb, error) {
+	cb, err := limiter.cache.Get(tenantId)
 	if err == caches.MissingValueError {
+		burst := limiter.config().Tenancy(tenantId).Burst
 		cb = &lbcb{
 			mutex:             sync.Mutex{},
-			availableCapacity: limiter.config.Tenancy(tenantId).Burst,
+			availableCapacity: burst,
+			burst:             burst,
 			timeOfLastAccess:  limiter.clock.Now(),
 		}
 		limiter.cache.Put(tenantId, cb)
 	} else if err != nil {
-		return false
+		return nil, err
 	}
-
-	return cb.accessAttempt(tenantId, limiter.clock, limiter.config, leakyBucketAccessCost(accessCost))
+	return cb, nil
 }
 
 type leakyBucketAccessCost = float64
@@ -57,10 +102,13 @@ type leakyBucketRateLimiter struct {
 
 	// for testing algorithms involving time we need a mockable time source
 	clock ratelimit.Clock
+	// and likewise for the passage of time while blocked in Wait
+	after func(d time.Duration) <-chan time.Time
 
 	log ratelimit.Logger
 
-	config *Config
+	// replaced wholesale by UpdateLimits, never modified in place
+	settings atomic.Pointer[Config]
 }
 
 type StringLBCache interface {
@@ -71,29 +119,70 @@ type StringLBCache interface {
 type lbcb struct {
 	mutex             sync.Mutex
 	availableCapacity leakyBucketAccessCost
-	timeOfLastAccess  time.Time
+	// the burst as of the last refill, so that changes to it can be detected
+	burst            leakyBucketAccessCost
+	timeOfLastAccess time.Time
 }
 
-func (cb *lbcb) accessAttempt(tenantId string, clock ratelimit.Clock, config *Config, accessCost leakyBucketAccessCost) bool {
+// reserve is capacity which this access may not dip into, held back for more important accesses
+func (cb *lbcb) accessAttempt(tenantId string, clock ratelimit.Clock, config *Config, accessCost leakyBucketAccessCost, reserve leakyBucketAccessCost) ratelimit.Decision {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 
 	now := clock.Now()
-	tdiff := now.Sub(cb.timeOfLastAccess)
-
 	tenancy := config.Tenancy(tenantId)
+	cb.refill(now, tenancy)
+
+	quotaAvailable := accessCost+reserve <= cb.availableCapacity
+
+	if quotaAvailable {
+		cb.availableCapacity -= accessCost
+	}
+
+	return cb.decision(now, tenancy, accessCost, reserve, quotaAvailable)
+}
+
+// must hold the mutex
+func (cb *lbcb) refill(now time.Time, tenancy *TenantLimit) {
+	if cb.burst != tenancy.Burst {
+		// the tenant's limits have changed, carry over what they've used rather than what they have left,
+		// but don't put them into debt just because their burst shrank
+		used := cb.burst - cb.availableCapacity
+		cb.availableCapacity = math.Max(tenancy.Burst-used, math.Min(cb.availableCapacity, 0))
+		cb.burst = tenancy.Burst
+	}
+
+	tdiff := now.Sub(cb.timeOfLastAccess)
 	microsRefill := tenancy.Rate * float64(tdiff.Microseconds()) / 1_000_000.0
 	cb.availableCapacity = math.Min(
 		cb.availableCapacity+microsRefill,
 		tenancy.Burst,
 	)
+	// the refill has been banked, so it must not be counted again on the next access
+	cb.timeOfLastAccess = now
+}
 
-	quotaAvailable := accessCost <= cb.availableCapacity
-
-	if quotaAvailable {
-		cb.timeOfLastAccess = now
-		cb.availableCapacity -= accessCost
+// must hold the mutex, and the bucket must have been refilled as of now
+func (cb *lbcb) decision(now time.Time, tenancy *TenantLimit, accessCost leakyBucketAccessCost, reserve leakyBucketAccessCost, allowed bool) ratelimit.Decision {
+	decision := ratelimit.Decision{
+		Allowed:   allowed,
+		Remaining: uint64(math.Max(0, math.Floor(cb.availableCapacity-reserve))),
+		Limit:     uint64(math.Max(0, math.Floor(tenancy.Burst))),
+		Window:    timeToRefill(tenancy.Burst, tenancy.Rate),
+		ResetAt:   now.Add(timeToRefill(tenancy.Burst-cb.availableCapacity, tenancy.Rate)),
+	}
+	if !allowed {
+		// a request larger than the burst can never succeed, the best advice we have is to wait for a full bucket
+		shortfall := math.Min(accessCost+reserve, tenancy.Burst) - cb.availableCapacity
+		decision.RetryAfter = timeToRefill(shortfall, tenancy.Rate)
 	}
+	return decision
+}
 
-	return quotaAvailable
+// how long a bucket filling at rate takes to accumulate the given capacity
+func timeToRefill(capacity leakyBucketAccessCost, rate float64) time.Duration {
+	if capacity <= 0 || rate <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(capacity / rate * float64(time.Second)))
 }
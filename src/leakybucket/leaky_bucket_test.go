@@ -43,3 +43,100 @@ func Test_smoke_test_happy_path_with_http(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
 
 }
+
+func Test_decisions_report_remaining_quota_and_when_to_retry(t *testing.T) {
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 2, Burst: 4}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = test_clocks.FixedClock{T: start}
+
+	decision := limiter.Decide("tenant", 3)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(1), decision.Remaining)
+	assert.Equal(t, uint64(4), decision.Limit)
+	assert.Equal(t, start.Add(1500*time.Millisecond), decision.ResetAt)
+	assert.Equal(t, time.Duration(0), decision.RetryAfter)
+
+	decision = limiter.Decide("tenant", 2)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, uint64(1), decision.Remaining)
+	assert.Equal(t, 500*time.Millisecond, decision.RetryAfter)
+}
+
+func Test_denied_attempts_do_not_refill_the_bucket_twice(t *testing.T) {
+	clock := &test_clocks.CreepingClock{T: start, Increment: 250 * time.Millisecond}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 1}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+
+	assert.True(t, limiter.AttemptAccess("tenant", 1))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+	assert.True(t, limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_handlers_settle_their_actual_cost_after_serving(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 10, Burst: 10}
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+
+	limitedServlet := ratelimit.StdMiddleware(limiter)(
+		http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			assert.True(t, ratelimit.SetActualCost(req.Context(), 25))
+			resp.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	req := httptest.NewRequest("GET", "/export", &bytes.Buffer{})
+	resp := httptest.NewRecorder()
+	limitedServlet.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// fifteen units in debt, so a full second and a half before the next request
+	assert.False(t, limiter.AttemptAccess(req.RemoteAddr, 1))
+	clock.Advance(1500 * time.Millisecond)
+	assert.False(t, limiter.AttemptAccess(req.RemoteAddr, 1))
+	clock.Advance(100 * time.Millisecond)
+	assert.True(t, limiter.AttemptAccess(req.RemoteAddr, 1))
+}
+
+func Test_updated_limits_carry_over_what_tenants_have_used(t *testing.T) {
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 0, Burst: 100}
+		},
+		TenantCapacity: 2,
+	})
+	limiter.clock = test_clocks.FixedClock{T: start}
+	assert.True(t, limiter.AttemptAccess("grows", 30))
+	assert.True(t, limiter.AttemptAccess("shrinks", 80))
+
+	limiter.UpdateLimits(func(tenant string) *TenantLimit {
+		if tenant == "grows" {
+			return &TenantLimit{Rate: 0, Burst: 200}
+		}
+		return &TenantLimit{Rate: 0, Burst: 50}
+	})
+
+	decision := limiter.Decide("grows", 170)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(200), decision.Limit)
+
+	// used more than the new burst, but isn't driven into debt for it
+	decision = limiter.Decide("shrinks", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, uint64(0), decision.Remaining)
+}
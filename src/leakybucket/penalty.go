@@ -0,0 +1,181 @@
+package leakybucket
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+	"sync"
+	"time"
+)
+
+// How harshly tenants who keep retrying after being refused are punished. The zero value
+// is DefaultPenalties, and otherwise Threshold and BaseBan take DefaultPenalties' when zero.
+type Penalties struct {
+	// consecutive refusals tolerated before a ban
+	Threshold int
+	// the length of the first ban, each further offence doubling it
+	BaseBan time.Duration
+	// the longest a ban may grow to, unbounded when zero
+	MaxBan time.Duration
+	// each Decay a tenant goes without offending wipes one offence from their record,
+	// offences are never forgotten when zero
+	Decay time.Duration
+}
+
+var DefaultPenalties = Penalties{
+	Threshold: 5,
+	BaseBan:   30 * time.Second,
+	MaxBan:    time.Hour,
+	Decay:     15 * time.Minute,
+}
+
+// A leaky bucket which bans tenants who keep hammering it after being refused. Each run
+// of Threshold consecutive refusals is an offence, earning a ban of BaseBan doubled for
+// every other offence on the tenant's record. Banned tenants are refused without their
+// bucket being consulted, their Decision's RetryAfter being the time left on the ban.
+// Requests made while banned don't count towards the next offence, the ban is enough.
+func NewPenaltyRateLimiter(
+	config Config,
+	penalties Penalties,
+) *penaltyRateLimiter {
+	if penalties == (Penalties{}) {
+		penalties = DefaultPenalties
+	}
+	if penalties.Threshold < 1 {
+		penalties.Threshold = DefaultPenalties.Threshold
+	}
+	if penalties.BaseBan <= 0 {
+		penalties.BaseBan = DefaultPenalties.BaseBan
+	}
+	return &penaltyRateLimiter{
+		buckets:   NewRateLimiter(config),
+		penalties: penalties,
+		records:   NewStringPenaltyCache(config.TenantCapacity),
+	}
+}
+
+var _ ratelimit.DecidingRateLimiter = &penaltyRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &penaltyRateLimiter{}
+
+type penaltyRateLimiter struct {
+	buckets   *leakyBucketRateLimiter
+	penalties Penalties
+	records   StringPenaltyCache
+}
+
+type StringPenaltyCache interface {
+	Put(key string, value *penaltyBlock) *penaltyBlock
+	Get(key string) (result *penaltyBlock, err error)
+}
+
+// a tenant's record of offences
+type penaltyBlock struct {
+	mutex sync.Mutex
+	// refusals since the tenant was last admitted or banned
+	consecutive int
+	offences    int
+	// when offences was last changed, by an offence or by decay
+	offencesAsOf time.Time
+	bannedUntil  time.Time
+}
+
+func (limiter *penaltyRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *penaltyRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	record, err := limiter.record(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	now := limiter.buckets.clock.Now()
+	if now.Before(record.bannedUntil) {
+		return limiter.banned(tenantId, record, now)
+	}
+
+	decision := limiter.buckets.Decide(tenantId, accessCost)
+	if decision.Allowed {
+		record.consecutive = 0
+		return decision
+	}
+
+	record.consecutive++
+	if record.consecutive < limiter.penalties.Threshold {
+		return decision
+	}
+	record.consecutive = 0
+	record.decay(now, limiter.penalties.Decay)
+	record.offences++
+	record.offencesAsOf = now
+	record.bannedUntil = now.Add(limiter.penalties.ban(record.offences))
+	return limiter.banned(tenantId, record, now)
+}
+
+// Settles with the tenant's bucket, bans are unaffected, see leakyBucketRateLimiter.AdjustCost
+func (limiter *penaltyRateLimiter) AdjustCost(tenantId string, delta int64) {
+	limiter.buckets.AdjustCost(tenantId, delta)
+}
+
+// The time left on the tenant's ban, zero if they aren't banned.
+func (limiter *penaltyRateLimiter) Banned(tenantId string) time.Duration {
+	record, err := limiter.record(tenantId)
+	if err != nil {
+		return 0
+	}
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+	return max(0, record.bannedUntil.Sub(limiter.buckets.clock.Now()))
+}
+
+func (limiter *penaltyRateLimiter) record(tenantId string) (*penaltyBlock, error) {
+	record, err := limiter.records.Get(tenantId)
+	if err == caches.MissingValueError {
+		record = &penaltyBlock{}
+		limiter.records.Put(tenantId, record)
+	} else if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// must hold the record's mutex
+func (limiter *penaltyRateLimiter) banned(tenantId string, record *penaltyBlock, now time.Time) ratelimit.Decision {
+	tenancy := limiter.buckets.config().Tenancy(tenantId)
+	return ratelimit.Decision{
+		Allowed:    false,
+		Limit:      uint64(math.Max(0, math.Floor(tenancy.Burst))),
+		Window:     timeToRefill(tenancy.Burst, tenancy.Rate),
+		ResetAt:    record.bannedUntil,
+		RetryAfter: record.bannedUntil.Sub(now),
+	}
+}
+
+// must hold the mutex
+func (record *penaltyBlock) decay(now time.Time, decay time.Duration) {
+	if decay <= 0 || record.offences == 0 {
+		return
+	}
+	forgiven := int(now.Sub(record.offencesAsOf) / decay)
+	if forgiven > 0 {
+		record.offences = max(0, record.offences-forgiven)
+		record.offencesAsOf = record.offencesAsOf.Add(time.Duration(forgiven) * decay)
+	}
+}
+
+// the ban earned by the given offence, counting from one
+func (penalties Penalties) ban(offence int) time.Duration {
+	ban := penalties.BaseBan
+	for i := 1; i < offence; i++ {
+		if penalties.MaxBan > 0 && ban >= penalties.MaxBan || ban > math.MaxInt64/2 {
+			break
+		}
+		ban *= 2
+	}
+	if penalties.MaxBan > 0 {
+		ban = min(ban, penalties.MaxBan)
+	}
+	return ban
+}
@@ -0,0 +1,40 @@
+package leakybucket
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"sync"
+)
+
+func NewStringPenaltyCache(capacity int) privateStringPenaltyCache {
+	return WrapStringPenaltyCache(caches.NewLRUCache(capacity))
+}
+
+func WrapStringPenaltyCache(cache caches.Interface) privateStringPenaltyCache {
+	return privateStringPenaltyCache{
+		generic: cache,
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// genny is case-sensitive even though this has other meanings in go, so we prefix the intent.
+type privateStringPenaltyCache struct {
+	mutex   *sync.RWMutex
+	generic caches.Interface
+}
+
+// see caches.Interface for contract
+func (cache privateStringPenaltyCache) Put(key string, value *penaltyBlock) *penaltyBlock {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	result, _ := cache.generic.Put(key, value).(*penaltyBlock)
+	return result
+}
+
+// see caches.Interface for contract
+func (cache privateStringPenaltyCache) Get(key string) (result *penaltyBlock, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	result, _ = value.(*penaltyBlock)
+	return
+}
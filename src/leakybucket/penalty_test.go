@@ -0,0 +1,125 @@
+package leakybucket
+
+import (
+	ratelimit "github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newPenaltyLimiter(clock ratelimit.Clock, penalties Penalties) *penaltyRateLimiter {
+	limiter := NewPenaltyRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 2}
+		},
+		TenantCapacity: 10,
+	}, penalties)
+	limiter.buckets.clock = clock
+	return limiter
+}
+
+var harsh = Penalties{Threshold: 3, BaseBan: time.Minute, MaxBan: 5 * time.Minute, Decay: time.Hour}
+
+// drains the tenant's bucket and then keeps on asking until banned
+func offend(limiter *penaltyRateLimiter, tenantId string) ratelimit.Decision {
+	var decision ratelimit.Decision
+	for i := 0; i < 100 && limiter.Banned(tenantId) == 0; i++ {
+		decision = limiter.Decide(tenantId, 1)
+	}
+	return decision
+}
+
+func Test_penalties_default_rather_than_never_banning(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	assert.Equal(t, DefaultPenalties, newPenaltyLimiter(clock, Penalties{}).penalties)
+
+	// zero bounds and decay still mean unbounded and unforgiving
+	limiter := newPenaltyLimiter(clock, Penalties{MaxBan: time.Minute})
+	assert.Equal(t, Penalties{Threshold: 5, BaseBan: 30 * time.Second, MaxBan: time.Minute}, limiter.penalties)
+	offend(limiter, "t")
+	assert.Equal(t, 30*time.Second, limiter.Banned("t"))
+}
+
+func Test_repeated_refusals_earn_a_ban(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := newPenaltyLimiter(clock, harsh)
+
+	assert.True(t, limiter.AttemptAccess("t", 1))
+	assert.True(t, limiter.AttemptAccess("t", 1))
+	assert.False(t, limiter.AttemptAccess("t", 1))
+	assert.False(t, limiter.AttemptAccess("t", 1))
+	assert.Equal(t, time.Duration(0), limiter.Banned("t"))
+
+	decision := limiter.Decide("t", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Minute, decision.RetryAfter)
+
+	// the bucket has long since refilled, but the ban stands
+	clock.Advance(59 * time.Second)
+	decision = limiter.Decide("t", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+
+	clock.Advance(time.Second)
+	assert.True(t, limiter.AttemptAccess("t", 1))
+	assert.True(t, limiter.AttemptAccess("other", 1))
+}
+
+func Test_admission_resets_the_count_of_refusals(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := newPenaltyLimiter(clock, harsh)
+	limiter.AttemptAccess("t", 2)
+
+	for i := 0; i < 5; i++ {
+		assert.False(t, limiter.AttemptAccess("t", 1))
+		assert.False(t, limiter.AttemptAccess("t", 1))
+		clock.Advance(time.Second)
+		assert.True(t, limiter.AttemptAccess("t", 1))
+	}
+	assert.Equal(t, time.Duration(0), limiter.Banned("t"))
+}
+
+func Test_bans_double_up_to_the_maximum(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := newPenaltyLimiter(clock, harsh)
+
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		assert.Equal(t, expected, offend(limiter, "t").RetryAfter)
+		clock.Advance(expected)
+	}
+}
+
+func Test_offences_decay(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := newPenaltyLimiter(clock, harsh)
+
+	offend(limiter, "t")
+	clock.Advance(time.Minute)
+	assert.Equal(t, 2*time.Minute, offend(limiter, "t").RetryAfter)
+
+	// an hour of good behaviour forgives one offence, the second offence is then the only one left
+	clock.Advance(time.Hour + 2*time.Minute)
+	assert.Equal(t, 2*time.Minute, offend(limiter, "t").RetryAfter)
+	clock.Advance(3 * time.Hour)
+	assert.Equal(t, time.Minute, offend(limiter, "t").RetryAfter)
+}
+
+func Test_bans_are_reported_through_retry_after(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := newPenaltyLimiter(clock, harsh)
+	offend(limiter, "t")
+	clock.Advance(30 * time.Second)
+
+	servlet := ratelimit.Middleware(limiter, func(_ *http.Request) string { return "t" }, ratelimit.FixedRequestCost)(
+		http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+			resp.WriteHeader(http.StatusOK)
+		}))
+	resp := httptest.NewRecorder()
+	servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "30", resp.Header().Get("Retry-After"))
+}
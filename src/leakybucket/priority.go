@@ -0,0 +1,66 @@
+package leakybucket
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+)
+
+// The fraction of each bucket's burst which requests of a priority must leave untouched.
+// Critical requests may drain a bucket completely, less important ones are refused while
+// there is still capacity left for those above them.
+type Reserves map[ratelimit.Priority]float64
+
+var DefaultReserves = Reserves{
+	ratelimit.CriticalPriority:  0,
+	ratelimit.DefaultPriority:   0.2,
+	ratelimit.SheddablePriority: 0.5,
+}
+
+// Typically shared by every tenant, i.e. behind a tenant identifier which returns a fixed key,
+// so that as the server as a whole nears its limit the least important traffic is shed first.
+func NewPriorityRateLimiter(
+	config Config,
+	reserves Reserves,
+) *priorityRateLimiter {
+	if reserves == nil {
+		reserves = DefaultReserves
+	}
+	return &priorityRateLimiter{
+		buckets:  NewRateLimiter(config),
+		reserves: reserves,
+	}
+}
+
+var _ ratelimit.PriorityRateLimiter = &priorityRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &priorityRateLimiter{}
+
+// Without a priority, accesses are DefaultPriority.
+type priorityRateLimiter struct {
+	buckets  *leakyBucketRateLimiter
+	reserves Reserves
+}
+
+func (limiter *priorityRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *priorityRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	return limiter.DecideWithPriority(tenantId, accessCost, ratelimit.DefaultPriority)
+}
+
+func (limiter *priorityRateLimiter) DecideWithPriority(tenantId string, accessCost uint64, priority ratelimit.Priority) ratelimit.Decision {
+	buckets := limiter.buckets
+	cb, err := buckets.controlBlock(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+
+	fraction := math.Max(0, math.Min(1, limiter.reserves[priority]))
+	reserve := fraction * buckets.config().Tenancy(tenantId).Burst
+	return cb.accessAttempt(tenantId, buckets.clock, buckets.config(), leakyBucketAccessCost(accessCost), reserve)
+}
+
+// Settlement doesn't care for priority, see leakyBucketRateLimiter.AdjustCost
+func (limiter *priorityRateLimiter) AdjustCost(tenantId string, delta int64) {
+	limiter.buckets.AdjustCost(tenantId, delta)
+}
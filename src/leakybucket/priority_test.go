@@ -0,0 +1,69 @@
+package leakybucket
+
+import (
+	ratelimit "github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_lower_priorities_are_shed_first(t *testing.T) {
+	limiter := NewPriorityRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 10, Burst: 10}
+		},
+		TenantCapacity: 1,
+	}, nil)
+	limiter.buckets.clock = test_clocks.FixedClock{T: start}
+
+	limitedServlet := ratelimit.Middleware(
+		limiter,
+		func(_ *http.Request) string { return "global" },
+		ratelimit.FixedRequestCost,
+		ratelimit.WithPriority(ratelimit.PriorityFromHeader("X-Priority")),
+	)(http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	}))
+
+	admitted := func(priority string) int {
+		count := 0
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Priority", priority)
+			resp := httptest.NewRecorder()
+			limitedServlet.ServeHTTP(resp, req)
+			if resp.Code == http.StatusOK {
+				count++
+			}
+		}
+		return count
+	}
+
+	// sheddable traffic leaves half the bucket, default traffic a fifth, and critical none
+	assert.Equal(t, 5, admitted("sheddable"))
+	assert.Equal(t, 3, admitted(""))
+	assert.Equal(t, 2, admitted("critical"))
+}
+
+func Test_priority_decisions_report_capacity_above_the_reserve(t *testing.T) {
+	limiter := NewPriorityRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 10}
+		},
+		TenantCapacity: 1,
+	}, nil)
+	limiter.buckets.clock = test_clocks.FixedClock{T: start}
+
+	decision := limiter.DecideWithPriority("global", 4, ratelimit.SheddablePriority)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, uint64(1), decision.Remaining)
+
+	decision = limiter.DecideWithPriority("global", 2, ratelimit.SheddablePriority)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+
+	assert.True(t, limiter.DecideWithPriority("global", 6, ratelimit.CriticalPriority).Allowed)
+}
@@ -0,0 +1,118 @@
+package leakybucket
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+	"sync"
+	"time"
+)
+
+// A claim on capacity which has already been taken from the tenant's bucket.
+// The bucket may be driven into debt by a reservation, in which case the holder
+// is expected to delay acting until the debt would have been repaid.
+type Reservation struct {
+	ok        bool
+	tenantId  string
+	cb        *lbcb
+	limiter   *leakyBucketRateLimiter
+	timeToAct time.Time
+
+	mutex    sync.Mutex
+	refunded leakyBucketAccessCost
+	reserved leakyBucketAccessCost
+}
+
+// Unlike AttemptAccess, Reserve succeeds whenever the cost could ever be satisfied,
+// borrowing from future refills if need be. Check OK, then wait out Delay before acting.
+func (limiter *leakyBucketRateLimiter) Reserve(tenantId string, accessCost uint64) *Reservation {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return &Reservation{ok: false}
+	}
+
+	cost := leakyBucketAccessCost(accessCost)
+	timeToAct, ok := cb.reserve(tenantId, limiter.clock, limiter.config(), cost)
+	if !ok {
+		return &Reservation{ok: false}
+	}
+	return &Reservation{
+		ok:        true,
+		tenantId:  tenantId,
+		cb:        cb,
+		limiter:   limiter,
+		timeToAct: timeToAct,
+		reserved:  cost,
+	}
+}
+
+// false when the cost exceeds the tenant's burst or the tenant's bucket never refills
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// How long from now the holder must wait before the reserved capacity is really theirs.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return time.Duration(math.MaxInt64)
+	}
+	delay := r.timeToAct.Sub(r.limiter.clock.Now())
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Returns all capacity not already refunded to the tenant's bucket.
+func (r *Reservation) Cancel() {
+	r.Refund(math.MaxUint64)
+}
+
+// Returns up to amount of the reserved capacity to the tenant's bucket, e.g. when
+// a request turned out to be cheaper than anticipated. Refunds never fill the
+// bucket beyond its burst, and never return more than was reserved.
+func (r *Reservation) Refund(amount uint64) {
+	if !r.ok {
+		return
+	}
+
+	r.mutex.Lock()
+	refund := math.Min(leakyBucketAccessCost(amount), r.reserved-r.refunded)
+	r.refunded += refund
+	r.mutex.Unlock()
+
+	if refund > 0 {
+		r.cb.charge(r.tenantId, r.limiter.clock, r.limiter.config(), -refund)
+	}
+}
+
+func (cb *lbcb) reserve(tenantId string, clock ratelimit.Clock, config *Config, accessCost leakyBucketAccessCost) (time.Time, bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := clock.Now()
+	tenancy := config.Tenancy(tenantId)
+	cb.refill(now, tenancy)
+
+	if accessCost > tenancy.Burst {
+		return time.Time{}, false
+	}
+
+	debt := accessCost - cb.availableCapacity
+	if debt > 0 && tenancy.Rate <= 0 {
+		return time.Time{}, false
+	}
+
+	cb.availableCapacity -= accessCost
+	return now.Add(timeToRefill(debt, tenancy.Rate)), true
+}
+
+// Unconditionally moves capacity in or out of the bucket. Negative charges are refunds
+// and will not overfill the bucket, positive charges may leave the bucket in debt.
+func (cb *lbcb) charge(tenantId string, clock ratelimit.Clock, config *Config, amount leakyBucketAccessCost) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	tenancy := config.Tenancy(tenantId)
+	cb.refill(clock.Now(), tenancy)
+	cb.availableCapacity = math.Min(cb.availableCapacity-amount, tenancy.Burst)
+}
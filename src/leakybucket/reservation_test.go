@@ -0,0 +1,62 @@
+package leakybucket
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func reservingLimiter(limit TenantLimit) (*leakyBucketRateLimiter, *test_clocks.ManualClock) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &limit
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+	return limiter, clock
+}
+
+func Test_reservations_borrow_from_future_refills(t *testing.T) {
+	limiter, clock := reservingLimiter(TenantLimit{Rate: 2, Burst: 4})
+
+	first := limiter.Reserve("tenant", 4)
+	assert.True(t, first.OK())
+	assert.Equal(t, time.Duration(0), first.Delay())
+
+	second := limiter.Reserve("tenant", 3)
+	assert.True(t, second.OK())
+	assert.Equal(t, 1500*time.Millisecond, second.Delay())
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 500*time.Millisecond, second.Delay())
+}
+
+func Test_reservations_can_be_refunded(t *testing.T) {
+	limiter, _ := reservingLimiter(TenantLimit{Rate: 1, Burst: 10})
+
+	reservation := limiter.Reserve("tenant", 10)
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	reservation.Refund(3)
+	assert.True(t, limiter.AttemptAccess("tenant", 3))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	// only the remaining seven may come back, and never beyond the burst
+	reservation.Cancel()
+	reservation.Cancel()
+	assert.True(t, limiter.AttemptAccess("tenant", 7))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_impossible_reservations_are_not_ok(t *testing.T) {
+	limiter, _ := reservingLimiter(TenantLimit{Rate: 1, Burst: 1})
+	assert.False(t, limiter.Reserve("tenant", 2).OK())
+
+	limiter, _ = reservingLimiter(TenantLimit{Rate: 0, Burst: 1})
+	assert.True(t, limiter.Reserve("tenant", 1).OK())
+	assert.False(t, limiter.Reserve("tenant", 1).OK())
+}
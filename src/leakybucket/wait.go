@@ -0,0 +1,53 @@
+package leakybucket
+
+import (
+	"context"
+	"errors"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"time"
+)
+
+var ExceedsBurstError = errors.New("access cost exceeds the tenant's burst and can never be satisfied")
+var NeverRefillsError = errors.New("the tenant's bucket does not refill")
+var WouldExceedDeadlineError = errors.New("waiting for capacity would exceed the context deadline")
+
+var _ ratelimit.WaitingRateLimiter = &leakyBucketRateLimiter{}
+
+// Blocks until the tenant's bucket can afford accessCost and then consumes it.
+// Returns early, having consumed nothing, if the context is cancelled or
+// if its deadline would pass before enough capacity accumulates.
+func (limiter *leakyBucketRateLimiter) Wait(ctx context.Context, tenantId string, accessCost uint64) error {
+	// the deadline is wall clock time, but waiting happens on the limiter's clock, so convert
+	// it into a budget once and measure what's been spent against the limiter's clock alone
+	started := limiter.clock.Now()
+	deadline, hasDeadline := ctx.Deadline()
+	budget := time.Until(deadline)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// checked on every pass, UpdateLimits may have lowered the burst while we slept
+		if leakyBucketAccessCost(accessCost) > limiter.config().Tenancy(tenantId).Burst {
+			return ExceedsBurstError
+		}
+
+		decision := limiter.Decide(tenantId, accessCost)
+		if decision.Allowed {
+			return nil
+		} else if decision.RetryAfter <= 0 {
+			return NeverRefillsError
+		}
+
+		if hasDeadline && budget-limiter.clock.Now().Sub(started) < decision.RetryAfter {
+			return WouldExceedDeadlineError
+		}
+
+		// other waiters may beat us to the capacity, in which case we go around again
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-limiter.after(decision.RetryAfter):
+		}
+	}
+}
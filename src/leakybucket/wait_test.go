@@ -0,0 +1,79 @@
+package leakybucket
+
+import (
+	"context"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func waitingLimiter(limit TenantLimit) (*leakyBucketRateLimiter, *test_clocks.ManualClock) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewRateLimiter(Config{
+		Tenancy: func(tenant string) *TenantLimit {
+			return &limit
+		},
+		TenantCapacity: 1,
+	})
+	limiter.clock = clock
+	limiter.after = clock.After
+	return limiter, clock
+}
+
+func Test_wait_blocks_until_capacity_refills(t *testing.T) {
+	limiter, clock := waitingLimiter(TenantLimit{Rate: 2, Burst: 2})
+
+	assert.NoError(t, limiter.Wait(context.Background(), "tenant", 2))
+	assert.Equal(t, start, clock.Now())
+
+	assert.NoError(t, limiter.Wait(context.Background(), "tenant", 1))
+	assert.Equal(t, start.Add(500*time.Millisecond), clock.Now())
+}
+
+func Test_wait_gives_up_early_when_the_deadline_is_too_close(t *testing.T) {
+	// the limiter's clock is nowhere near the hardware clock the deadline is set by
+	limiter, clock := waitingLimiter(TenantLimit{Rate: 1, Burst: 1})
+	assert.True(t, limiter.AttemptAccess("tenant", 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, limiter.Wait(ctx, "tenant", 1))
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, WouldExceedDeadlineError, limiter.Wait(ctx, "tenant", 1))
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+}
+
+func Test_wait_respects_cancellation(t *testing.T) {
+	limiter, _ := waitingLimiter(TenantLimit{Rate: 1, Burst: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, context.Canceled, limiter.Wait(ctx, "tenant", 1))
+}
+
+func Test_wait_refuses_impossible_costs(t *testing.T) {
+	limiter, _ := waitingLimiter(TenantLimit{Rate: 1, Burst: 1})
+	assert.Equal(t, ExceedsBurstError, limiter.Wait(context.Background(), "tenant", 2))
+
+	limiter, _ = waitingLimiter(TenantLimit{Rate: 0, Burst: 1})
+	assert.True(t, limiter.AttemptAccess("tenant", 1))
+	assert.Equal(t, NeverRefillsError, limiter.Wait(context.Background(), "tenant", 1))
+}
+
+func Test_wait_gives_up_when_the_burst_is_lowered_beneath_the_cost(t *testing.T) {
+	limiter, clock := waitingLimiter(TenantLimit{Rate: 1, Burst: 2})
+	assert.True(t, limiter.AttemptAccess("tenant", 2))
+	limiter.after = func(d time.Duration) <-chan time.Time {
+		limiter.UpdateLimits(func(tenant string) *TenantLimit {
+			return &TenantLimit{Rate: 1, Burst: 1}
+		})
+		return clock.After(d)
+	}
+
+	assert.Equal(t, ExceedsBurstError, limiter.Wait(context.Background(), "tenant", 2))
+}
@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var ByteLimitExceededError = errors.New("the tenant's byte allowance is exhausted")
+
+// A RateLimiter which can block until the tenant can afford a cost, e.g. a leaky bucket.
+type WaitingRateLimiter interface {
+	RateLimiter
+	Wait(ctx context.Context, userId string, requestCost uint64) error
+}
+
+// A cost function for limiters counting bytes rather than requests, charging the
+// request body up front when its length is known. Bodies of unknown length cost
+// nothing up front, and can be metered as they are read with WithByteMetering.
+func ContentLengthCost(req *http.Request) uint64 {
+	if req.ContentLength > 0 {
+		return uint64(req.ContentLength)
+	}
+	return 0
+}
+
+type ByteMetering struct {
+	// Bytes are charged as they pass in chunks of at most this many, 32KiB when zero.
+	// A chunk larger than the tenant's burst can never be afforded, so keep it well below.
+	ChunkSize int
+
+	// When the tenant runs out, sleep until they can afford the next chunk rather than
+	// failing the read or write. Only WaitingRateLimiters can throttle, others always fail.
+	Throttle bool
+}
+
+// Charges the tenant for bytes as they are streamed, to the same limiter as requests:
+// request bodies of unknown length as they are read, and the response as it is written.
+// Bodies with a known length are not metered, charge for them with ContentLengthCost.
+//
+// A tenant who runs out mid-stream is either throttled, see ByteMetering.Throttle, or
+// has their reads and writes fail with ByteLimitExceededError, which handlers should
+// treat as a reason to abandon the request.
+func WithByteMetering(metering ByteMetering) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		if metering.ChunkSize <= 0 {
+			metering.ChunkSize = 32 * 1024
+		}
+		config.metering = &metering
+	}
+}
+
+func (metering *ByteMetering) wrap(limiter RateLimiter, tenantId string, resp http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	m := &meter{ctx: req.Context(), limiter: limiter, tenantId: tenantId, metering: metering}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength < 0 {
+		metered := *req
+		metered.Body = &meteredBody{ReadCloser: req.Body, meter: m}
+		req = &metered
+	}
+	return &meteredWriter{ResponseWriter: resp, meter: m}, req
+}
+
+type meter struct {
+	ctx      context.Context
+	limiter  RateLimiter
+	tenantId string
+	metering *ByteMetering
+}
+
+func (m *meter) charge(bytes int) error {
+	if bytes <= 0 || Decide(m.limiter, m.tenantId, uint64(bytes)).Allowed {
+		return nil
+	}
+	waiter, ok := m.limiter.(WaitingRateLimiter)
+	if !m.metering.Throttle || !ok {
+		return ByteLimitExceededError
+	}
+	if err := waiter.Wait(m.ctx, m.tenantId, uint64(bytes)); err != nil {
+		return fmt.Errorf("%w: %w", ByteLimitExceededError, err)
+	}
+	return nil
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	meter *meter
+
+	// read from the body but not yet paid for, and so not yet handed out
+	buffer  []byte
+	pending []byte
+	err     error
+}
+
+// Bytes are paid for before the handler sees them, so a refused chunk stays with the
+// body. The size of the next chunk is only known once read, so it is held back until
+// paid for, and reading again after a refusal retries the same chunk.
+func (body *meteredBody) Read(p []byte) (int, error) {
+	if len(body.pending) == 0 && body.err == nil {
+		if body.buffer == nil {
+			body.buffer = make([]byte, body.meter.metering.ChunkSize)
+		}
+		n, err := body.ReadCloser.Read(body.buffer[:min(len(p), len(body.buffer))])
+		body.pending, body.err = body.buffer[:n], err
+	}
+
+	size := min(len(p), len(body.pending))
+	if err := body.meter.charge(size); err != nil {
+		return 0, err
+	}
+	n := copy(p, body.pending[:size])
+	body.pending = body.pending[n:]
+	if len(body.pending) > 0 {
+		return n, nil
+	}
+	err := body.err
+	body.err = nil
+	return n, err
+}
+
+type meteredWriter struct {
+	http.ResponseWriter
+	meter *meter
+}
+
+// each chunk is paid for before it is sent
+func (writer *meteredWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+writer.meter.metering.ChunkSize)]
+		if err := writer.meter.charge(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := writer.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// let http.ResponseController reach Flush, Hijack and friends
+func (writer *meteredWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
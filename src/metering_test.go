@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a counting limiter whose tenants are topped back up whenever they wait
+type refillingLimiter struct {
+	*countingLimiter
+	waits int
+}
+
+func (limiter *refillingLimiter) Wait(ctx context.Context, userId string, requestCost uint64) error {
+	limiter.waits++
+	limiter.used[userId] = 0
+	if !limiter.AttemptAccess(userId, requestCost) {
+		return io.ErrShortBuffer
+	}
+	return nil
+}
+
+func oneTenant(req *http.Request) string {
+	return "tenant"
+}
+
+func meteredServe(limiter RateLimiter, metering ByteMetering, req *http.Request, servlet http.HandlerFunc) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	Middleware(limiter, oneTenant, ContentLengthCost, WithByteMetering(metering))(servlet).ServeHTTP(resp, req)
+	return resp
+}
+
+func Test_content_length_is_charged_up_front(t *testing.T) {
+	limiter := newCountingLimiter(10)
+	upload := func() int {
+		return meteredServe(limiter, ByteMetering{}, httptest.NewRequest("PUT", "/", strings.NewReader("123456")), okServlet).Code
+	}
+
+	assert.Equal(t, http.StatusOK, upload())
+	assert.Equal(t, http.StatusTooManyRequests, upload())
+	assert.Equal(t, uint64(6), limiter.used["tenant"])
+	assert.Equal(t, uint64(0), ContentLengthCost(httptest.NewRequest("GET", "/", nil)))
+}
+
+func Test_responses_are_charged_as_they_are_written(t *testing.T) {
+	limiter := newCountingLimiter(10)
+	var written int
+	var err error
+	resp := meteredServe(limiter, ByteMetering{ChunkSize: 4}, httptest.NewRequest("GET", "/", nil),
+		func(resp http.ResponseWriter, req *http.Request) {
+			written, err = resp.Write([]byte("abcdefghijkl"))
+		})
+
+	// two chunks of four fit in the allowance of ten, the third doesn't
+	assert.Equal(t, 8, written)
+	assert.True(t, errors.Is(err, ByteLimitExceededError))
+	assert.Equal(t, "abcdefgh", resp.Body.String())
+	assert.Equal(t, uint64(8), limiter.used["tenant"])
+}
+
+func Test_streamed_bodies_are_charged_as_they_are_read(t *testing.T) {
+	limiter := newCountingLimiter(10)
+	req := httptest.NewRequest("POST", "/", strings.NewReader("abcdefghijkl"))
+	req.ContentLength = -1
+	var read []byte
+	var err error
+	meteredServe(limiter, ByteMetering{ChunkSize: 5}, req, func(resp http.ResponseWriter, req *http.Request) {
+		read, err = io.ReadAll(req.Body)
+	})
+
+	assert.True(t, errors.Is(err, ByteLimitExceededError))
+	// the chunk which broke the bank never reached the handler
+	assert.Equal(t, "abcdefghij", string(read))
+	assert.Equal(t, uint64(10), limiter.used["tenant"])
+}
+
+func Test_streamed_bodies_which_exactly_exhaust_the_allowance_are_read_in_full(t *testing.T) {
+	limiter := newCountingLimiter(12)
+	req := httptest.NewRequest("POST", "/", strings.NewReader("abcdefghijkl"))
+	req.ContentLength = -1
+	var read []byte
+	var err error
+	meteredServe(limiter, ByteMetering{ChunkSize: 5}, req, func(resp http.ResponseWriter, req *http.Request) {
+		read, err = io.ReadAll(req.Body)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefghijkl", string(read))
+	assert.Equal(t, uint64(12), limiter.used["tenant"])
+}
+
+func Test_throttled_streams_wait_for_capacity(t *testing.T) {
+	limiter := &refillingLimiter{countingLimiter: newCountingLimiter(8)}
+	var err error
+	resp := meteredServe(limiter, ByteMetering{ChunkSize: 4, Throttle: true}, httptest.NewRequest("GET", "/", nil),
+		func(resp http.ResponseWriter, req *http.Request) {
+			_, err = resp.Write([]byte("abcdefghijklmnop"))
+		})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefghijklmnop", resp.Body.String())
+	assert.Equal(t, 1, limiter.waits)
+}
+
+func Test_limiters_which_cannot_wait_are_never_throttled(t *testing.T) {
+	limiter := newCountingLimiter(4)
+	var err error
+	meteredServe(limiter, ByteMetering{ChunkSize: 4, Throttle: true}, httptest.NewRequest("GET", "/", nil),
+		func(resp http.ResponseWriter, req *http.Request) {
+			_, err = resp.Write([]byte("abcdefgh"))
+		})
+
+	assert.True(t, errors.Is(err, ByteLimitExceededError))
+}
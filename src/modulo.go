@@ -11,13 +11,18 @@ func (modVal ModuloRel) Increment() ModuloRel {
 	return modVal.Add(1)
 }
 
+// x may be negative, the result is always in [0, Mod)
 func (modVal ModuloRel) Add(x int) ModuloRel {
 	return ModuloRel{
-		Value: (modVal.Value + x) % modVal.Mod,
+		Value: ((modVal.Value+x)%modVal.Mod + modVal.Mod) % modVal.Mod,
 		Mod:   modVal.Mod,
 	}
 }
 
+func (modVal ModuloRel) Decrement() ModuloRel {
+	return modVal.Add(-1)
+}
+
 func (modVal ModuloRel) String() string {
 	return fmt.Sprintf("%d `Mod` %d", modVal.Value, modVal.Mod)
 }
@@ -0,0 +1,14 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_modulo_arithmetic_wraps_in_both_directions(t *testing.T) {
+	mod := ModuloRel{Value: 1, Mod: 4}
+	assert.Equal(t, 0, mod.Decrement().Value)
+	assert.Equal(t, 3, mod.Add(-2).Value)
+	assert.Equal(t, 3, mod.Add(-6).Value)
+	assert.Equal(t, 1, mod.Add(4).Value)
+}
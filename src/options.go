@@ -0,0 +1,73 @@
+package ratelimit
+
+import "net/http"
+
+type MiddlewareOption func(config *middlewareConfig)
+
+type middlewareConfig struct {
+	headers   HeaderStyle
+	clock     Clock
+	queue     *QueueConfig
+	priority  func(req *http.Request) Priority
+	routes    *RouteTable
+	metering  *ByteMetering
+	rejection http.Handler
+	shadows   []Shadow
+	dryRun    func(req *http.Request, rejection Rejection)
+}
+
+func newMiddlewareConfig(options []MiddlewareOption) *middlewareConfig {
+	config := &middlewareConfig{
+		headers:   RetryAfterOnly,
+		clock:     HardwareClock{},
+		rejection: http.HandlerFunc(plainRejection),
+	}
+	for _, option := range options {
+		option(config)
+	}
+	return config
+}
+
+// Selects which rate limit headers are written on both allowed and rejected responses.
+func WithHeaders(style HeaderStyle) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.headers = style
+	}
+}
+
+// The clock used to express a Decision's ResetAt as a relative number of seconds,
+// and to time out queued requests. Queued requests are retried on the clock too if it's
+// an AlarmClock, and on the hardware clock otherwise.
+func WithClock(clock Clock) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.clock = clock
+	}
+}
+
+// Rather than refusing over-limit requests outright, hold them until their tenant has
+// capacity again, see QueueConfig.
+func WithQueueing(queue QueueConfig) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.queue = &queue
+	}
+}
+
+// Classifies each request for PriorityRateLimiters, other limiters ignore priority.
+func WithPriority(priority func(req *http.Request) Priority) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.priority = priority
+	}
+}
+
+// how a request is put to the limiter, both initially and when retried from the queue
+func (config *middlewareConfig) decider(limiter RateLimiter, req *http.Request, tenantId string, cost uint64) func() Decision {
+	if prioritised, ok := limiter.(PriorityRateLimiter); ok && config.priority != nil {
+		priority := config.priority(req)
+		return func() Decision {
+			return prioritised.DecideWithPriority(tenantId, cost, priority)
+		}
+	}
+	return func() Decision {
+		return Decide(limiter, tenantId, cost)
+	}
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/fixedwindow"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Limits described in a file rather than in code, so that operators can change them
+// without a rebuild. YAML, or JSON since it is also YAML, e.g.
+//
+//	algorithm: leakybucket
+//	tenant_capacity: 10000
+//	default: {rate: 100, burst: 200}
+//	tenants:
+//	  acme: {rate: 1000, burst: 2000}
+//	routes:
+//	  - {method: POST, path: /export, cost: 50}
+//	  - {path: /health, exempt: true}
+//	exempt_tenants: [internal-monitoring]
+//	dry_run: false
+type Policy struct {
+	Algorithm      string           `yaml:"algorithm"`
+	TenantCapacity int              `yaml:"tenant_capacity"`
+	Default        Limit            `yaml:"default"`
+	Tenants        map[string]Limit `yaml:"tenants"`
+	Routes         []Route          `yaml:"routes"`
+	ExemptTenants  []string         `yaml:"exempt_tenants"`
+	// evaluate the limits but serve every request, see ratelimit.WithDryRun
+	DryRun bool `yaml:"dry_run"`
+
+	routes *ratelimit.RouteTable
+}
+
+const (
+	LeakyBucket          = "leakybucket"
+	GCRA                 = "gcra"
+	SlidingWindowLog     = "sliding_window_log"
+	SlidingWindowCounter = "sliding_window_counter"
+	FixedWindow          = "fixed_window"
+)
+
+// Which fields apply depends on the algorithm:
+// rate and burst for leakybucket and gcra, limit and window for the sliding windows,
+// and quota, period and timezone for fixed_window.
+type Limit struct {
+	Rate     float64       `yaml:"rate"`
+	Burst    float64       `yaml:"burst"`
+	Limit    uint64        `yaml:"limit"`
+	Window   time.Duration `yaml:"window"`
+	Quota    uint64        `yaml:"quota"`
+	Period   string        `yaml:"period"`
+	Timezone string        `yaml:"timezone"`
+}
+
+// Requests are matched against routes in order, the first match wins. An empty method
+// matches any method, and paths are ratelimit.Route patterns, so a path ending in *
+// matches any path with the preceding prefix. Requests matching no route cost 1.
+type Route struct {
+	// optional, see ratelimit.Route
+	Name   string `yaml:"name"`
+	Method string `yaml:"method"`
+	Path   string `yaml:"path"`
+	Cost   uint64 `yaml:"cost"`
+	// exempt requests bypass the limiter entirely
+	Exempt bool `yaml:"exempt"`
+}
+
+// name is only used to prefix error messages, e.g. "limits.yaml:12: burst must be positive"
+func Parse(name string, source []byte) (*Policy, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(source, &root); err != nil {
+		return nil, yamlErrors(name, err)
+	}
+
+	policy := &Policy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(source))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(policy); err != nil && err != io.EOF {
+		return nil, yamlErrors(name, err)
+	}
+
+	if err := policy.validate(name, &root); err != nil {
+		return nil, err
+	}
+	// validation has already vetted every path
+	policy.routes, _ = ratelimit.NewRouteTable(1, policy.routeTable()...)
+	return policy, nil
+}
+
+func (policy *Policy) routeTable() []ratelimit.Route {
+	routes := make([]ratelimit.Route, len(policy.Routes))
+	for i, route := range policy.Routes {
+		routes[i] = route.asRoute()
+	}
+	return routes
+}
+
+func (route *Route) asRoute() ratelimit.Route {
+	return ratelimit.Route{Name: route.Name, Method: route.Method, Pattern: route.Path, Cost: route.Cost}
+}
+
+func (policy *Policy) route(req *http.Request) *Route {
+	if policy.routes == nil {
+		return nil
+	}
+	if match, ok := policy.routes.Match(req); ok {
+		return &policy.Routes[match.Index]
+	}
+	return nil
+}
+
+func (policy *Policy) cost(req *http.Request) uint64 {
+	if route := policy.route(req); route != nil {
+		return route.Cost
+	}
+	return 1
+}
+
+var periods = map[string]fixedwindow.Period{
+	"minute": fixedwindow.Minute,
+	"hour":   fixedwindow.Hour,
+	"day":    fixedwindow.Day,
+	"month":  fixedwindow.Month,
+}
+
+func yamlErrors(name string, err error) error {
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		invalid := make(Errors, 0, len(typeError.Errors))
+		for _, msg := range typeError.Errors {
+			invalid = append(invalid, fmt.Errorf("%s:%s", name, strings.TrimPrefix(msg, "line ")))
+		}
+		return invalid
+	}
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	if located, ok := strings.CutPrefix(msg, "line "); ok {
+		return fmt.Errorf("%s:%s", name, located)
+	}
+	// some syntax errors don't know where they are
+	return fmt.Errorf("%s: %s", name, msg)
+}
@@ -0,0 +1,263 @@
+package policy
+
+import (
+	"context"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/slidingwindow"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlPolicy = `
+algorithm: leakybucket
+tenant_capacity: 100
+default:
+  rate: 1
+  burst: 3
+tenants:
+  acme:
+    rate: 1
+    burst: 60
+routes:
+  - method: POST
+    path: /export
+    cost: 50
+  - path: /health
+    exempt: true
+  - path: /static/*
+    cost: 0
+exempt_tenants: [internal]
+`
+
+func okServlet(resp http.ResponseWriter, _ *http.Request) {
+	resp.WriteHeader(http.StatusOK)
+}
+
+func byHeader(req *http.Request) string {
+	return req.Header.Get("X-Tenant")
+}
+
+func Test_policies_build_a_working_middleware(t *testing.T) {
+	stack, err := Build("limits.yaml", []byte(yamlPolicy))
+	assert.NoError(t, err)
+	servlet := stack.Middleware(byHeader)(http.HandlerFunc(okServlet))
+
+	serve := func(tenantId string, method string, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Tenant", tenantId)
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// the default burst of three, with health checks and static content free
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("nobody", "GET", "/"))
+		assert.Equal(t, http.StatusOK, serve("nobody", "GET", "/health"))
+		assert.Equal(t, http.StatusOK, serve("nobody", "GET", "/static/app.js"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("nobody", "GET", "/"))
+	assert.Equal(t, http.StatusOK, serve("nobody", "GET", "/health"))
+
+	// acme can afford one export, but not two
+	assert.Equal(t, http.StatusOK, serve("acme", "POST", "/export"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("acme", "POST", "/export"))
+	assert.Equal(t, http.StatusOK, serve("acme", "GET", "/export"))
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, http.StatusOK, serve("internal", "POST", "/export"))
+	}
+}
+
+func Test_json_is_accepted_and_selects_the_algorithm(t *testing.T) {
+	stack, err := Build("limits.json", []byte(`{
+		"algorithm": "sliding_window_log",
+		"tenant_capacity": 10,
+		"default": {"limit": 2, "window": "1m"}
+	}`))
+	assert.NoError(t, err)
+	assert.IsType(t, slidingwindow.NewLogRateLimiter(slidingwindow.Config{TenantCapacity: 1}), stack.Limiter)
+
+	assert.True(t, stack.Limiter.AttemptAccess("tenant", 2))
+	assert.False(t, stack.Limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_routes_may_have_params(t *testing.T) {
+	policy, err := Parse("limits.yaml", []byte(`
+tenant_capacity: 100
+default: {rate: 1, burst: 3}
+routes:
+  - {name: export, method: POST, path: "/users/{id}/export", cost: 50}
+  - {path: "/users/*/avatar", cost: 0}
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(50), policy.cost(httptest.NewRequest("POST", "/users/7/export", nil)))
+	assert.Equal(t, uint64(0), policy.cost(httptest.NewRequest("GET", "/users/7/avatar", nil)))
+	assert.Equal(t, uint64(1), policy.cost(httptest.NewRequest("GET", "/users/7", nil)))
+
+	_, err = Parse("limits.yaml", []byte(`
+tenant_capacity: 100
+default: {rate: 1, burst: 3}
+routes:
+  - {path: "/users/{id...}/export"}
+`))
+	assert.EqualError(t, err, `limits.yaml:5: route pattern "/users/{id...}/export" may only have a {param...} at the end`)
+}
+
+func Test_errors_name_the_offending_line(t *testing.T) {
+	_, err := Parse("limits.yaml", []byte(`
+algorithm: fixed_window
+tenant_capacity: 100
+default:
+  quota: 1000
+  period: fortnight
+  timezone: Europe/Atlantis
+tenants:
+  acme:
+    period: day
+routes:
+  - path: export
+`))
+	assert.EqualError(t, err, `limits.yaml:6: unknown period "fortnight", expected minute, hour, day or month
+limits.yaml:7: unknown timezone "Europe/Atlantis"
+limits.yaml:9: quota must be positive
+limits.yaml:12: route path "export" must begin with /`)
+
+	_, err = Parse("limits.yaml", []byte(`
+tenant_capacity: 100
+default:
+  rate: fast
+  bust: 10
+`))
+	assert.EqualError(t, err, `limits.yaml:4: cannot unmarshal !!str `+"`fast`"+` into float64
+limits.yaml:5: field bust not found in type policy.Limit`)
+
+	_, err = Parse("limits.json", []byte(`{"tenant_capacity": 100, "default": {"rate": 1 "burst": 2}}`))
+	assert.EqualError(t, err, `limits.json: did not find expected ',' or '}'`)
+}
+
+func Test_reloading_keeps_each_tenants_usage(t *testing.T) {
+	stack, err := Build("limits.yaml", []byte(yamlPolicy))
+	assert.NoError(t, err)
+	assert.True(t, stack.Limiter.AttemptAccess("nobody", 2))
+
+	assert.NoError(t, stack.Reload("limits.yaml", []byte(strings.Replace(yamlPolicy, "burst: 3", "burst: 10", 1))))
+	assert.True(t, stack.Limiter.AttemptAccess("nobody", 8))
+	assert.False(t, stack.Limiter.AttemptAccess("nobody", 1))
+
+	err = stack.Reload("limits.yaml", []byte(strings.Replace(yamlPolicy, "leakybucket", "gcra", 1)))
+	assert.EqualError(t, err, "limits.yaml: the algorithm can't be changed from leakybucket to gcra without a restart")
+	err = stack.Reload("limits.yaml", []byte(strings.Replace(yamlPolicy, "burst: 3", "burst: -3", 1)))
+	assert.EqualError(t, err, "limits.yaml:6: burst must be positive")
+	assert.Equal(t, float64(10), stack.Policy().Default.Burst)
+}
+
+func Test_watched_files_are_reloaded_when_modified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(yamlPolicy), 0644))
+	stack, err := Load(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go stack.Watch(ctx, path, time.Millisecond, func(err error) { errs <- err })
+
+	updated := []byte(strings.Replace(yamlPolicy, "burst: 3", "burst: 7", 1))
+	assert.NoError(t, os.WriteFile(path, updated, 0644))
+	// not every filesystem records modification times finely enough to notice a quick rewrite
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)))
+
+	for deadline := time.Now().Add(time.Second); stack.Policy().Default.Burst != 7; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("policy was never reloaded")
+		}
+	}
+	assert.Empty(t, errs)
+}
+
+func Test_dry_run_policies_serve_every_request(t *testing.T) {
+	stack, err := Build("limits.yaml", []byte(yamlPolicy+"dry_run: true\n"))
+	assert.NoError(t, err)
+	var unenforced []ratelimit.Rejection
+	stack.Report = func(req *http.Request, rejection ratelimit.Rejection) {
+		unenforced = append(unenforced, rejection)
+	}
+	servlet := stack.Middleware(byHeader)(http.HandlerFunc(okServlet))
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", "nobody")
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, serve())
+	}
+	assert.Len(t, unenforced, 1)
+
+	// enforcement starts with the reload, and the tenant's usage carries over
+	assert.NoError(t, stack.Reload("limits.yaml", []byte(yamlPolicy)))
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+}
+
+func Test_requests_are_identified_once_and_costed_by_the_policy_they_arrived_under(t *testing.T) {
+	cheap := []byte(yamlPolicy)
+	expensive := []byte(strings.Replace(yamlPolicy, "cost: 0", "cost: 50", 1))
+	stack, err := Build("limits.yaml", cheap)
+	assert.NoError(t, err)
+
+	// every identification reloads the policy, as though an edit landed mid request
+	identified := 0
+	servlet := stack.Middleware(func(req *http.Request) string {
+		identified++
+		assert.NoError(t, stack.Reload("limits.yaml", expensive))
+		return byHeader(req)
+	})(http.HandlerFunc(okServlet))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, stack.Reload("limits.yaml", cheap))
+		req := httptest.NewRequest("GET", "/static/app.js", nil)
+		req.Header.Set("X-Tenant", "nobody")
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+	assert.Equal(t, 10, identified)
+}
+
+func Test_policies_may_shadow_each_other(t *testing.T) {
+	current, err := Build("current.yaml", []byte(yamlPolicy))
+	assert.NoError(t, err)
+	proposed, err := Build("proposed.yaml", []byte(strings.Replace(yamlPolicy, "burst: 3", "burst: 1", 1)))
+	assert.NoError(t, err)
+	var unenforced []ratelimit.Rejection
+	servlet := current.Middleware(byHeader, proposed.Shadow(func(req *http.Request, rejection ratelimit.Rejection) {
+		unenforced = append(unenforced, rejection)
+	}))(http.HandlerFunc(okServlet))
+	serve := func(tenantId string, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Tenant", tenantId)
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("nobody", "/"))
+		assert.Equal(t, http.StatusOK, serve("internal", "/"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("nobody", "/"))
+
+	// the proposed burst of one is exceeded from the second request on, and the exempt tenant never counts
+	assert.Len(t, unenforced, 3)
+	assert.Equal(t, "nobody", unenforced[0].TenantId)
+}
@@ -0,0 +1,294 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/fixedwindow"
+	"github.com/npxcomplete/http-rate-limit/src/gcra"
+	"github.com/npxcomplete/http-rate-limit/src/leakybucket"
+	"github.com/npxcomplete/http-rate-limit/src/slidingwindow"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A policy made ready for use, and kept up to date by Reload or Watch.
+//
+// Reloading swaps the whole policy at once, but the limiter, and with it every tenant's
+// state, lives on. Each tenant picks up its new limits on its next request.
+type Stack struct {
+	Limiter ratelimit.RateLimiter
+	// Receives the rejections not enforced while the policy is a dry run, logged to
+	// stdout when nil. Read by Middleware, so set it beforehand.
+	Report func(req *http.Request, rejection ratelimit.Rejection)
+
+	current atomic.Pointer[compiled]
+}
+
+// a policy along with its limits converted into whatever the algorithm needs
+type compiled struct {
+	policy    *Policy
+	exempt    map[string]bool
+	fallback  any
+	overrides map[string]any
+}
+
+func Load(path string) (*Stack, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Build(path, source)
+}
+
+// see Parse
+func Build(name string, source []byte) (*Stack, error) {
+	policy, err := Parse(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	stack := &Stack{}
+	stack.current.Store(compile(policy))
+	stack.Limiter = stack.limiter()
+	return stack, nil
+}
+
+func (stack *Stack) Policy() *Policy {
+	return stack.current.Load().policy
+}
+
+// Replaces the policy in force, provided the new one is valid. Limits, routes and
+// exemptions may all change, but the algorithm and tenant capacity are fixed for
+// the life of the limiter.
+func (stack *Stack) Reload(name string, source []byte) error {
+	policy, err := Parse(name, source)
+	if err != nil {
+		return err
+	}
+
+	previous := stack.Policy()
+	if policy.Algorithm != previous.Algorithm {
+		return fmt.Errorf("%s: the algorithm can't be changed from %s to %s without a restart", name, previous.Algorithm, policy.Algorithm)
+	}
+	if policy.TenantCapacity != previous.TenantCapacity {
+		return fmt.Errorf("%s: tenant_capacity can't be changed without a restart", name)
+	}
+
+	stack.current.Store(compile(policy))
+	return nil
+}
+
+// Polls the file every interval, reloading it whenever its modification time changes,
+// until the context is done. Policies which fail to load are reported to onError and
+// otherwise ignored, leaving the last good policy in force.
+//
+// The file is always reloaded on the first poll, so that nothing written between
+// loading the stack and starting to watch it can be missed.
+func (stack *Stack) Watch(ctx context.Context, path string, interval time.Duration, onError func(err error)) {
+	var lastModified time.Time
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			onError(err)
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		source, err := os.ReadFile(path)
+		if err == nil {
+			err = stack.Reload(path, source)
+		}
+		if err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Wraps servlets with the policy's limiter, costs and exemptions. While the policy is
+// a dry run, requests are served whatever the limiter decides, see ratelimit.WithDryRun.
+//
+// Each request is identified once, and judged entirely by the policy in force when it
+// arrived, even if the policy is reloaded while it is being served.
+func (stack *Stack) Middleware(
+	tenantIdentifier func(r *http.Request) string,
+	options ...ratelimit.MiddlewareOption,
+) func(servlet http.Handler) http.HandlerFunc {
+	identified := func(req *http.Request) string {
+		if arrival, ok := req.Context().Value(arrivalKey{}).(*arrival); ok {
+			return arrival.tenantId
+		}
+		return tenantIdentifier(req)
+	}
+	cost := func(req *http.Request) uint64 {
+		if arrival, ok := req.Context().Value(arrivalKey{}).(*arrival); ok {
+			return arrival.policy.policy.cost(req)
+		}
+		return stack.Cost(req)
+	}
+	limited := ratelimit.Middleware(stack.Limiter, identified, cost, options...)
+	dryRun := ratelimit.Middleware(stack.Limiter, identified, cost,
+		append(options[:len(options):len(options)], ratelimit.WithDryRun(stack.Report))...)
+
+	return func(servlet http.Handler) http.HandlerFunc {
+		limitedServlet := limited(servlet)
+		dryRunServlet := dryRun(servlet)
+		return func(resp http.ResponseWriter, req *http.Request) {
+			current := stack.current.Load()
+			tenantId := tenantIdentifier(req)
+			if current.exempts(req, tenantId) {
+				servlet.ServeHTTP(resp, req)
+				return
+			}
+
+			req = req.WithContext(context.WithValue(req.Context(), arrivalKey{}, &arrival{policy: current, tenantId: tenantId}))
+			if current.policy.DryRun {
+				dryRunServlet.ServeHTTP(resp, req)
+			} else {
+				limitedServlet.ServeHTTP(resp, req)
+			}
+		}
+	}
+}
+
+// the tenant and policy a request was judged by on arrival
+type arrival struct {
+	policy   *compiled
+	tenantId string
+}
+
+type arrivalKey struct{}
+
+// What a request costs under the policy currently in force.
+func (stack *Stack) Cost(req *http.Request) uint64 {
+	return stack.Policy().cost(req)
+}
+
+// Evaluates this stack's policy in the shadow of another's middleware, e.g. a new policy
+// alongside the one in force, without ever refusing a request, see ratelimit.Shadow.
+// Its exemptions are honoured, but whether it is itself a dry run makes no difference.
+func (stack *Stack) Shadow(report func(req *http.Request, rejection ratelimit.Rejection)) ratelimit.MiddlewareOption {
+	if report == nil {
+		report = ratelimit.LogRejections(ratelimit.StdOutLogger{})
+	}
+	return ratelimit.WithShadow(ratelimit.Shadow{
+		Limiter: stack.Limiter,
+		Cost: func(req *http.Request) uint64 {
+			// exempt requests are free, and there's no cheaper way to spot them without the tenant
+			if route := stack.Policy().route(req); route != nil && route.Exempt {
+				return 0
+			}
+			return stack.Cost(req)
+		},
+		Report: func(req *http.Request, rejection ratelimit.Rejection) {
+			if stack.current.Load().exempt[rejection.TenantId] {
+				return
+			}
+			report(req, rejection)
+		},
+	})
+}
+
+func (current *compiled) exempts(req *http.Request, tenantId string) bool {
+	route := current.policy.route(req)
+	return (route != nil && route.Exempt) || current.exempt[tenantId]
+}
+
+func compile(policy *Policy) *compiled {
+	convert := converter(policy.Algorithm)
+	result := &compiled{
+		policy:    policy,
+		exempt:    make(map[string]bool, len(policy.ExemptTenants)),
+		fallback:  convert(policy.Default),
+		overrides: make(map[string]any, len(policy.Tenants)),
+	}
+	for _, tenantId := range policy.ExemptTenants {
+		result.exempt[tenantId] = true
+	}
+	for tenantId, limit := range policy.Tenants {
+		result.overrides[tenantId] = convert(limit)
+	}
+	return result
+}
+
+// Limits are converted once per load, so the limiters' hot paths are plain map lookups.
+func converter(algorithm string) func(limit Limit) any {
+	switch algorithm {
+	case GCRA:
+		return func(limit Limit) any {
+			return &gcra.TenantLimit{Rate: limit.Rate, Burst: limit.Burst}
+		}
+	case SlidingWindowLog, SlidingWindowCounter:
+		return func(limit Limit) any {
+			return &slidingwindow.TenantLimit{Limit: limit.Limit, Window: limit.Window}
+		}
+	case FixedWindow:
+		return func(limit Limit) any {
+			// validation has already vouched for both of these
+			location, _ := time.LoadLocation(limit.Timezone)
+			period := periods[strings.ToLower(limit.Period)]
+			return &fixedwindow.TenantLimit{Quota: limit.Quota, Period: period, Location: location}
+		}
+	default:
+		return func(limit Limit) any {
+			return &leakybucket.TenantLimit{Rate: limit.Rate, Burst: limit.Burst}
+		}
+	}
+}
+
+// Always consults the policy currently in force.
+func tenancy[T any](stack *Stack) func(tenant string) *T {
+	return func(tenant string) *T {
+		current := stack.current.Load()
+		if limit, ok := current.overrides[tenant]; ok {
+			return limit.(*T)
+		}
+		return current.fallback.(*T)
+	}
+}
+
+func (stack *Stack) limiter() ratelimit.RateLimiter {
+	policy := stack.Policy()
+	switch policy.Algorithm {
+	case GCRA:
+		return gcra.NewRateLimiter(gcra.Config{
+			TenantCapacity: policy.TenantCapacity,
+			Tenancy:        tenancy[gcra.TenantLimit](stack),
+		})
+	case SlidingWindowLog:
+		return slidingwindow.NewLogRateLimiter(slidingwindow.Config{
+			TenantCapacity: policy.TenantCapacity,
+			Tenancy:        tenancy[slidingwindow.TenantLimit](stack),
+		})
+	case SlidingWindowCounter:
+		return slidingwindow.NewCounterRateLimiter(slidingwindow.Config{
+			TenantCapacity: policy.TenantCapacity,
+			Tenancy:        tenancy[slidingwindow.TenantLimit](stack),
+		})
+	case FixedWindow:
+		return fixedwindow.NewRateLimiter(fixedwindow.Config{
+			TenantCapacity: policy.TenantCapacity,
+			Tenancy:        tenancy[fixedwindow.TenantLimit](stack),
+		})
+	default:
+		return leakybucket.NewRateLimiter(leakybucket.Config{
+			TenantCapacity: policy.TenantCapacity,
+			Tenancy:        tenancy[leakybucket.TenantLimit](stack),
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every problem found with a policy, one per line.
+type Errors []error
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// A problem with a value in the policy, and where to find it.
+type InvalidValue struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (err *InvalidValue) Error() string {
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Msg)
+}
+
+type validator struct {
+	name string
+	root *yaml.Node
+	errs Errors
+}
+
+// path names the offending key, as a sequence of mapping keys and sequence indices
+func (v *validator) fail(msg string, path ...string) {
+	v.errs = append(v.errs, &InvalidValue{File: v.name, Line: line(v.root, path), Msg: msg})
+}
+
+func (policy *Policy) validate(name string, root *yaml.Node) error {
+	v := &validator{name: name, root: root}
+
+	switch policy.Algorithm {
+	case "":
+		policy.Algorithm = LeakyBucket
+	case LeakyBucket, GCRA, SlidingWindowLog, SlidingWindowCounter, FixedWindow:
+	default:
+		v.fail(fmt.Sprintf(
+			"unknown algorithm %q, expected one of %s, %s, %s, %s or %s", policy.Algorithm,
+			LeakyBucket, GCRA, SlidingWindowLog, SlidingWindowCounter, FixedWindow,
+		), "algorithm")
+	}
+
+	if policy.TenantCapacity <= 0 {
+		v.fail("tenant_capacity must be positive", "tenant_capacity")
+	}
+
+	policy.Default.validate(v, policy.Algorithm, "default")
+	// in a stable order, so the same file always produces the same errors
+	tenantIds := make([]string, 0, len(policy.Tenants))
+	for tenantId := range policy.Tenants {
+		tenantIds = append(tenantIds, tenantId)
+	}
+	sort.Strings(tenantIds)
+	for _, tenantId := range tenantIds {
+		limit := policy.Tenants[tenantId]
+		limit.validate(v, policy.Algorithm, "tenants", tenantId)
+	}
+
+	for i, route := range policy.Routes {
+		index := strconv.Itoa(i)
+		if !strings.HasPrefix(route.Path, "/") {
+			v.fail(fmt.Sprintf("route path %q must begin with /", route.Path), "routes", index, "path")
+		} else if _, err := ratelimit.NewRouteTable(1, route.asRoute()); err != nil {
+			v.fail(err.Error(), "routes", index, "path")
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (limit *Limit) validate(v *validator, algorithm string, path ...string) {
+	at := func(field string) []string {
+		return append(append([]string{}, path...), field)
+	}
+
+	switch algorithm {
+	case LeakyBucket, GCRA:
+		if limit.Rate < 0 {
+			v.fail("rate must not be negative", at("rate")...)
+		}
+		if limit.Burst <= 0 {
+			v.fail("burst must be positive", at("burst")...)
+		}
+	case SlidingWindowLog, SlidingWindowCounter:
+		if limit.Limit == 0 {
+			v.fail("limit must be positive", at("limit")...)
+		}
+		if limit.Window <= 0 {
+			v.fail("window must be a positive duration, e.g. 60s", at("window")...)
+		}
+	case FixedWindow:
+		if limit.Quota == 0 {
+			v.fail("quota must be positive", at("quota")...)
+		}
+		if _, ok := periods[strings.ToLower(limit.Period)]; !ok {
+			v.fail(fmt.Sprintf("unknown period %q, expected minute, hour, day or month", limit.Period), at("period")...)
+		}
+		if _, err := time.LoadLocation(limit.Timezone); err != nil {
+			v.fail(fmt.Sprintf("unknown timezone %q", limit.Timezone), at("timezone")...)
+		}
+	}
+}
+
+// The line of the deepest node along path which exists, so that a missing field
+// is reported against the mapping it should have been in.
+func line(root *yaml.Node, path []string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	found := node.Line
+
+	for _, step := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == step {
+					found = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(step); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+				found = next.Line
+			}
+		}
+		if next == nil {
+			return found
+		}
+		node = next
+	}
+	return found
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The zero value is DefaultPriority, so requests nobody has classified are treated as ordinary.
+type Priority int
+
+const (
+	DefaultPriority Priority = iota
+	// must be served if at all possible, e.g. checkout or login
+	CriticalPriority
+	// the first to go when capacity is short, e.g. prefetching or analytics
+	SheddablePriority
+)
+
+func (priority Priority) String() string {
+	switch priority {
+	case CriticalPriority:
+		return "critical"
+	case SheddablePriority:
+		return "sheddable"
+	default:
+		return "default"
+	}
+}
+
+// Reads the priority from a request header holding "critical", "default" or "sheddable".
+// Anything else, including no header at all, is DefaultPriority.
+//
+// Clients can claim whatever priority they please, so this is only appropriate when the
+// header is set by something trusted, such as a gateway in front of the service.
+func PriorityFromHeader(header string) func(req *http.Request) Priority {
+	return func(req *http.Request) Priority {
+		switch strings.ToLower(strings.TrimSpace(req.Header.Get(header))) {
+		case "critical":
+			return CriticalPriority
+		case "sheddable":
+			return SheddablePriority
+		default:
+			return DefaultPriority
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package ratelimit
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Over-limit requests wait in per-tenant queues, and as capacity frees up they are
+// admitted in weighted fair order: each request is stamped with a virtual finish time
+// which grows by cost/weight for every request its tenant already has queued, and the
+// earliest finish is offered capacity first. A tenant which briefly bursts over its limit
+// is slowed down rather than refused, without being able to crowd out anyone else.
+type QueueConfig struct {
+	// how many requests each tenant may have waiting, beyond which they're refused at once,
+	// defaults to 10
+	MaxDepth int
+	// how long a request may wait before it is refused after all, defaults to 10 seconds
+	MaxWait time.Duration
+	// a tenant's share of capacity relative to the others, defaults to 1 for everyone
+	Weight func(tenantId string) float64
+	// the status of requests which waited and were refused anyway, defaults to 429
+	RejectStatus int
+}
+
+// How often to retry limiters which can't say when capacity will be available.
+const queuePollInterval = 10 * time.Millisecond
+
+const defaultQueueDepth = 10
+const defaultQueueWait = 10 * time.Second
+
+func (config *middlewareConfig) newFairQueue() *fairQueue {
+	if config.queue == nil {
+		return nil
+	}
+	queue := &fairQueue{
+		config:   *config.queue,
+		clock:    config.clock,
+		after:    time.After,
+		tenants:  map[string]*tenantQueue{},
+		arrivals: make(chan struct{}, 1),
+	}
+	if alarm, ok := config.clock.(AlarmClock); ok {
+		queue.after = alarm.After
+	}
+	if queue.config.MaxDepth <= 0 {
+		queue.config.MaxDepth = defaultQueueDepth
+	}
+	if queue.config.MaxWait <= 0 {
+		queue.config.MaxWait = defaultQueueWait
+	}
+	if queue.config.Weight == nil {
+		queue.config.Weight = func(_ string) float64 { return 1 }
+	}
+	if queue.config.RejectStatus == 0 {
+		queue.config.RejectStatus = http.StatusTooManyRequests
+	}
+	return queue
+}
+
+type fairQueue struct {
+	config QueueConfig
+	clock  Clock
+	after  func(d time.Duration) <-chan time.Time
+
+	mutex   sync.Mutex
+	tenants map[string]*tenantQueue
+	// every tenant with anyone waiting, earliest finishing first
+	heads   tenantHeap
+	waiting int
+	// the finish time of the last request admitted, new arrivals can't start before it
+	virtualTime float64
+	// how many requests have ever queued, breaking ties in finish time by order of arrival
+	arrived     uint64
+	dispatching bool
+	arrivals    chan struct{}
+}
+
+// Each tenant's requests are admitted first in first out, so only the one at the front
+// is ever offered capacity, and the tenants are ordered by theirs.
+type tenantQueue struct {
+	tenantId string
+	waiters  []*waiter
+	// the finish time of the tenant's last queued request, new arrivals start after it
+	lastFinish float64
+	// position in heads, -1 while left out of it
+	index int
+}
+
+type waiter struct {
+	tenantId string
+	cost     uint64
+	finish   float64
+	arrival  uint64
+	deadline time.Time
+	// no point asking the limiter again before this
+	retryAt time.Time
+	latest  Decision
+	decide  func() Decision
+	done    chan Decision
+}
+
+// Blocks until the request is admitted, or must be refused after all.
+// Returns the final decision and, if refused, the status to refuse with.
+// decide is asked again each time the request is offered capacity.
+func (queue *fairQueue) wait(ctx context.Context, tenantId string, cost uint64, denied Decision, decide func() Decision) (Decision, int) {
+	now := queue.clock.Now()
+	if denied.RetryAfter > queue.config.MaxWait {
+		return denied, http.StatusTooManyRequests
+	}
+
+	queue.mutex.Lock()
+	if tenant := queue.tenants[tenantId]; tenant != nil && len(tenant.waiters) >= queue.config.MaxDepth {
+		queue.mutex.Unlock()
+		return denied, http.StatusTooManyRequests
+	}
+	w := queue.enqueue(now, tenantId, cost, denied, now.Add(retryInterval(denied)), decide)
+	queue.mutex.Unlock()
+	return queue.await(ctx, w)
+}
+
+// As wait, for a request not yet put to the limiter. While its tenant has requests waiting,
+// capacity freed up for the tenant is theirs, so newcomers go to the back of the queue
+// rather than asking first. false if the tenant has no one waiting, and the request
+// should be decided as usual.
+func (queue *fairQueue) join(ctx context.Context, tenantId string, cost uint64, decide func() Decision) (Decision, int, bool) {
+	now := queue.clock.Now()
+
+	queue.mutex.Lock()
+	tenant := queue.tenants[tenantId]
+	if tenant == nil {
+		queue.mutex.Unlock()
+		return Decision{}, 0, false
+	}
+	// the tenant's latest refusal is the best guess at this one's
+	latest := tenant.waiters[len(tenant.waiters)-1].latest
+	if len(tenant.waiters) >= queue.config.MaxDepth {
+		queue.mutex.Unlock()
+		return latest, http.StatusTooManyRequests, true
+	}
+	w := queue.enqueue(now, tenantId, cost, latest, now, decide)
+	queue.mutex.Unlock()
+	decision, status := queue.await(ctx, w)
+	return decision, status, true
+}
+
+func (queue *fairQueue) await(ctx context.Context, w *waiter) (Decision, int) {
+	select {
+	case queue.arrivals <- struct{}{}:
+	default: // the dispatcher already has news waiting
+	}
+
+	select {
+	case decision := <-w.done:
+		return decision, queue.config.RejectStatus
+	case <-ctx.Done():
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		if queue.remove(w) {
+			return w.latest, queue.config.RejectStatus
+		}
+		// the dispatcher got there first
+		return <-w.done, queue.config.RejectStatus
+	}
+}
+
+// must hold the mutex
+func (queue *fairQueue) enqueue(now time.Time, tenantId string, cost uint64, latest Decision, retryAt time.Time, decide func() Decision) *waiter {
+	tenant := queue.tenants[tenantId]
+	if tenant == nil {
+		tenant = &tenantQueue{tenantId: tenantId, lastFinish: queue.virtualTime, index: -1}
+		queue.tenants[tenantId] = tenant
+	}
+	start := math.Max(queue.virtualTime, tenant.lastFinish)
+	tenant.lastFinish = start + float64(cost)/queue.config.Weight(tenantId)
+	queue.arrived++
+
+	w := &waiter{
+		tenantId: tenantId,
+		cost:     cost,
+		finish:   tenant.lastFinish,
+		arrival:  queue.arrived,
+		deadline: now.Add(queue.config.MaxWait),
+		retryAt:  retryAt,
+		latest:   latest,
+		decide:   decide,
+		done:     make(chan Decision, 1),
+	}
+	tenant.waiters = append(tenant.waiters, w)
+	queue.waiting++
+	if len(tenant.waiters) == 1 {
+		heap.Push(&queue.heads, tenant)
+	}
+
+	if !queue.dispatching {
+		queue.dispatching = true
+		go queue.dispatch()
+	}
+	return w
+}
+
+// must hold the mutex, false if the waiter had already left the queue
+func (queue *fairQueue) remove(w *waiter) bool {
+	tenant := queue.tenants[w.tenantId]
+	if tenant == nil {
+		return false
+	}
+	for i, candidate := range tenant.waiters {
+		if candidate != w {
+			continue
+		}
+		tenant.waiters = append(tenant.waiters[:i], tenant.waiters[i+1:]...)
+		queue.waiting--
+		if len(tenant.waiters) == 0 {
+			delete(queue.tenants, w.tenantId)
+			if tenant.index >= 0 {
+				heap.Remove(&queue.heads, tenant.index)
+			}
+		} else if i == 0 && tenant.index >= 0 {
+			heap.Fix(&queue.heads, tenant.index)
+		}
+		return true
+	}
+	return false
+}
+
+// Runs for as long as anyone is waiting, offering capacity in finish order.
+func (queue *fairQueue) dispatch() {
+	for {
+		queue.mutex.Lock()
+		if queue.waiting == 0 {
+			queue.dispatching = false
+			queue.mutex.Unlock()
+			return
+		}
+		wake := queue.offerCapacity(queue.clock.Now())
+		queue.mutex.Unlock()
+
+		select {
+		case <-queue.after(wake):
+		case <-queue.arrivals:
+		}
+	}
+}
+
+// must hold the mutex, returns how long until there's any point trying again
+func (queue *fairQueue) offerCapacity(now time.Time) time.Duration {
+	wake := queue.config.MaxWait
+	// tenants whose front request was refused, the rest of theirs must wait too
+	blocked := []*tenantQueue{}
+	block := func(tenant *tenantQueue) {
+		if tenant.index >= 0 {
+			heap.Remove(&queue.heads, tenant.index)
+			blocked = append(blocked, tenant)
+		}
+	}
+
+	for queue.heads.Len() > 0 {
+		tenant := queue.heads[0]
+		w := tenant.waiters[0]
+		if w.retryAt.After(now) {
+			block(tenant)
+			wake = min(wake, w.retryAt.Sub(now))
+			continue
+		}
+
+		decision := w.decide()
+		if decision.Allowed {
+			queue.remove(w)
+			queue.virtualTime = math.Max(queue.virtualTime, w.finish)
+			w.done <- decision
+			continue
+		}
+
+		w.latest = decision
+		w.retryAt = now.Add(retryInterval(decision))
+		if w.retryAt.After(w.deadline) {
+			queue.remove(w)
+			w.done <- decision
+		} else {
+			wake = min(wake, w.retryAt.Sub(now))
+		}
+		block(tenant)
+	}
+
+	for _, tenant := range blocked {
+		heap.Push(&queue.heads, tenant)
+	}
+	return wake
+}
+
+func retryInterval(decision Decision) time.Duration {
+	if decision.RetryAfter <= 0 {
+		return queuePollInterval
+	}
+	return decision.RetryAfter
+}
+
+// container/heap's view of the tenants, ordered by the finish of their front request
+type tenantHeap []*tenantQueue
+
+func (heads tenantHeap) Len() int {
+	return len(heads)
+}
+
+func (heads tenantHeap) Less(i, j int) bool {
+	a, b := heads[i].waiters[0], heads[j].waiters[0]
+	if a.finish == b.finish {
+		return a.arrival < b.arrival
+	}
+	return a.finish < b.finish
+}
+
+func (heads tenantHeap) Swap(i, j int) {
+	heads[i], heads[j] = heads[j], heads[i]
+	heads[i].index = i
+	heads[j].index = j
+}
+
+func (heads *tenantHeap) Push(x any) {
+	tenant := x.(*tenantQueue)
+	tenant.index = len(*heads)
+	*heads = append(*heads, tenant)
+}
+
+func (heads *tenantHeap) Pop() any {
+	old := *heads
+	tenant := old[len(old)-1]
+	old[len(old)-1] = nil
+	tenant.index = -1
+	*heads = old[:len(old)-1]
+	return tenant
+}
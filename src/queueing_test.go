@@ -0,0 +1,258 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a pool of capacity shared by every tenant, topped up by hand
+type sharedPool struct {
+	mutex  sync.Mutex
+	tokens uint64
+}
+
+func (pool *sharedPool) AttemptAccess(userId string, requestCost uint64) bool {
+	return pool.Decide(userId, requestCost).Allowed
+}
+
+func (pool *sharedPool) Decide(userId string, requestCost uint64) Decision {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if requestCost > pool.tokens {
+		return Decision{Allowed: false, RetryAfter: time.Millisecond}
+	}
+	pool.tokens -= requestCost
+	return Decision{Allowed: true}
+}
+
+func (pool *sharedPool) add(tokens uint64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.tokens += tokens
+}
+
+func (queue *fairQueue) depth() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.waiting
+}
+
+// assert.Eventually can panic in this version of testify, hence polling by hand
+func awaitDepth(t *testing.T, queue *fairQueue, depth int) {
+	for deadline := time.Now().Add(time.Second); queue.depth() != depth; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never reached depth %d", depth)
+		}
+	}
+}
+
+func Test_queued_requests_are_admitted_in_weighted_fair_order(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{
+		MaxDepth: 5,
+		MaxWait:  time.Minute,
+		Weight: func(tenantId string) float64 {
+			if tenantId == "light" {
+				return 2
+			}
+			return 1
+		},
+	})})
+	queue := config.newFairQueue()
+
+	admitted := make(chan string)
+	enqueue := func(tenantId string) {
+		go func() {
+			decide := func() Decision { return pool.Decide(tenantId, 1) }
+			decision, _ := queue.wait(context.Background(), tenantId, 1, Decision{RetryAfter: time.Millisecond}, decide)
+			assert.True(t, decision.Allowed)
+			admitted <- tenantId
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		enqueue("heavy")
+		awaitDepth(t, queue, i+1)
+	}
+	enqueue("light")
+	awaitDepth(t, queue, 4)
+
+	// the light tenant arrived last, but its weight puts it at the front
+	order := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		pool.add(1)
+		order = append(order, <-admitted)
+	}
+	assert.Equal(t, []string{"light", "heavy", "heavy", "heavy"}, order)
+}
+
+func Test_newcomers_queue_behind_their_tenants_waiting_requests(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxDepth: 5, MaxWait: time.Minute})})
+	queue := config.newFairQueue()
+	decide := func() Decision { return pool.Decide("tenant", 1) }
+
+	// no one is waiting, so the newcomer is decided as usual
+	_, _, queued := queue.join(context.Background(), "tenant", 1, decide)
+	assert.False(t, queued)
+
+	admitted := make(chan string)
+	go func() {
+		decision, _ := queue.wait(context.Background(), "tenant", 1, Decision{RetryAfter: time.Millisecond}, decide)
+		assert.True(t, decision.Allowed)
+		admitted <- "waiting"
+	}()
+	awaitDepth(t, queue, 1)
+
+	// other tenants have no one to queue behind
+	_, _, queued = queue.join(context.Background(), "other", 1, func() Decision { return pool.Decide("other", 1) })
+	assert.False(t, queued)
+
+	go func() {
+		decision, _, queued := queue.join(context.Background(), "tenant", 1, decide)
+		assert.True(t, queued)
+		assert.True(t, decision.Allowed)
+		admitted <- "newcomer"
+	}()
+	awaitDepth(t, queue, 2)
+
+	order := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		pool.add(1)
+		order = append(order, <-admitted)
+	}
+	assert.Equal(t, []string{"waiting", "newcomer"}, order)
+}
+
+func Test_tenants_are_offered_capacity_in_finish_order(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxDepth: 5, MaxWait: time.Minute})})
+	queue := config.newFairQueue()
+
+	admitted := make(chan string)
+	enqueue := func(tenantId string) {
+		go func() {
+			decide := func() Decision { return pool.Decide(tenantId, 1) }
+			decision, _ := queue.wait(context.Background(), tenantId, 1, Decision{RetryAfter: time.Millisecond}, decide)
+			assert.True(t, decision.Allowed)
+			admitted <- tenantId
+		}()
+	}
+	// a's second request finishes after everyone else's first
+	for i, tenantId := range []string{"a", "a", "b", "c"} {
+		enqueue(tenantId)
+		awaitDepth(t, queue, i+1)
+	}
+
+	order := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		pool.add(1)
+		order = append(order, <-admitted)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a"}, order)
+}
+
+func Test_full_queues_refuse_at_once(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxDepth: 1, MaxWait: time.Minute})})
+	queue := config.newFairQueue()
+
+	first := make(chan Decision, 1)
+	go func() {
+		decide := func() Decision { return pool.Decide("tenant", 1) }
+		decision, _ := queue.wait(context.Background(), "tenant", 1, Decision{RetryAfter: time.Millisecond}, decide)
+		first <- decision
+	}()
+	awaitDepth(t, queue, 1)
+
+	decide := func() Decision { return pool.Decide("tenant", 1) }
+	decision, status := queue.wait(context.Background(), "tenant", 1, Decision{RetryAfter: time.Millisecond}, decide)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	pool.add(1)
+	assert.True(t, (<-first).Allowed)
+}
+
+func Test_queueing_middleware_refuses_requests_waiting_too_long(t *testing.T) {
+	servlet := Middleware(&sharedPool{}, UniqueTenantIdentifier, FixedRequestCost, WithQueueing(QueueConfig{
+		MaxDepth:     1,
+		MaxWait:      20 * time.Millisecond,
+		RejectStatus: http.StatusServiceUnavailable,
+	}))(http.HandlerFunc(okServlet))
+
+	resp := httptest.NewRecorder()
+	servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+}
+
+func Test_queued_requests_wait_on_the_middlewares_clock(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	refused := make(chan *httptest.ResponseRecorder)
+	go func() {
+		refused <- serve(fixedDecisions{Decision{RetryAfter: 10 * time.Second}},
+			WithClock(clock), WithQueueing(QueueConfig{MaxDepth: 1, MaxWait: time.Minute}))
+	}()
+
+	// a minute's wait on the hardware clock would outlast the test
+	select {
+	case resp := <-refused:
+		assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.True(t, clock.Now().Sub(start) >= time.Minute)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the queue slept on the hardware clock")
+	}
+}
+
+func Test_queues_default_to_waiting_ten_seconds(t *testing.T) {
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxDepth: 1})})
+	assert.Equal(t, defaultQueueWait, config.newFairQueue().config.MaxWait)
+
+	// rather than refusing anyone the limiter asks to retry
+	clock := &test_clocks.ManualClock{T: start}
+	resp := serve(fixedDecisions{Decision{RetryAfter: time.Second}}, WithClock(clock), WithQueueing(QueueConfig{MaxDepth: 1}))
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.True(t, clock.Now().Sub(start) >= defaultQueueWait)
+}
+
+func Test_newcomers_who_give_up_are_refused_like_their_tenant(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxDepth: 5, MaxWait: time.Minute})})
+	queue := config.newFairQueue()
+	decide := func() Decision { return pool.Decide("tenant", 1) }
+
+	waiting, stopWaiting := context.WithCancel(context.Background())
+	defer stopWaiting()
+	go queue.wait(waiting, "tenant", 1, Decision{RetryAfter: 30 * time.Second}, decide)
+	awaitDepth(t, queue, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	decision, status, queued := queue.join(ctx, "tenant", 1, decide)
+	assert.True(t, queued)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, 30*time.Second, decision.RetryAfter)
+}
+
+func Test_queues_default_to_a_depth_of_ten(t *testing.T) {
+	pool := &sharedPool{}
+	config := newMiddlewareConfig([]MiddlewareOption{WithQueueing(QueueConfig{MaxWait: time.Minute})})
+	queue := config.newFairQueue()
+	assert.Equal(t, defaultQueueDepth, queue.config.MaxDepth)
+
+	// rather than refusing everyone
+	admitted := make(chan Decision)
+	go func() {
+		decide := func() Decision { return pool.Decide("tenant", 1) }
+		decision, _ := queue.wait(context.Background(), "tenant", 1, Decision{RetryAfter: time.Millisecond}, decide)
+		admitted <- decision
+	}()
+	awaitDepth(t, queue, 1)
+	pool.add(1)
+	assert.True(t, (<-admitted).Allowed)
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Why Middleware refused a request, available to rejection handlers through RejectionFromContext.
+type Rejection struct {
+	TenantId string
+	// 429, or 503 for a request which timed out in the queue, see QueueConfig
+	Status   int
+	Decision Decision
+}
+
+// The rejection being served by Middleware, if any.
+func RejectionFromContext(ctx context.Context) (Rejection, bool) {
+	rejection, ok := ctx.Value(rejectionKey{}).(Rejection)
+	return rejection, ok
+}
+
+type rejectionKey struct{}
+
+// Serves refused requests with the given handler in place of the plain text default.
+// Rate limit headers have already been written when it is called, and it must write
+// the status found in RejectionFromContext.
+func WithRejection(handler http.Handler) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.rejection = handler
+	}
+}
+
+func rejectionStatus(req *http.Request) int {
+	if rejection, ok := RejectionFromContext(req.Context()); ok {
+		return rejection.Status
+	}
+	return http.StatusTooManyRequests
+}
+
+// the default
+func plainRejection(resp http.ResponseWriter, req *http.Request) {
+	resp.WriteHeader(rejectionStatus(req))
+	io.WriteString(resp, "Throttle limit exceeded.")
+}
+
+type ProblemConfig struct {
+	// a URI identifying the problem type, "about:blank" when empty
+	Type string
+
+	// The request header carrying the caller's correlation ID, X-Request-ID when empty.
+	// One is generated when the request has none, and either way it is echoed in the
+	// same response header, so that clients and operators can find each other's logs.
+	CorrelationHeader string
+}
+
+// Explains rejections with RFC 9457 problem details, e.g.
+//
+//	{"type": "about:blank", "title": "Too Many Requests", "status": 429,
+//	 "detail": "...", "tenant": "acme", "limit": 100, "retry_after": 3, "correlation_id": "..."}
+//
+// Clients preferring HTML or plain text, browsers say, are given that instead.
+func ProblemResponder(config ProblemConfig) http.Handler {
+	if config.Type == "" {
+		config.Type = "about:blank"
+	}
+	if config.CorrelationHeader == "" {
+		config.CorrelationHeader = "X-Request-ID"
+	}
+	return &problemResponder{config: config}
+}
+
+type problemResponder struct {
+	config ProblemConfig
+}
+
+type problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail"`
+	Tenant        string `json:"tenant"`
+	Limit         uint64 `json:"limit,omitempty"`
+	RetryAfter    int64  `json:"retry_after,omitempty"`
+	CorrelationId string `json:"correlation_id"`
+}
+
+func (responder *problemResponder) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	rejection, _ := RejectionFromContext(req.Context())
+	if rejection.Status == 0 {
+		rejection.Status = http.StatusTooManyRequests
+	}
+
+	correlationId := req.Header.Get(responder.config.CorrelationHeader)
+	if correlationId == "" {
+		correlationId = newCorrelationId()
+	}
+	details := problem{
+		Type:          responder.config.Type,
+		Title:         http.StatusText(rejection.Status),
+		Status:        rejection.Status,
+		Detail:        detail(rejection),
+		Tenant:        rejection.TenantId,
+		Limit:         rejection.Decision.Limit,
+		RetryAfter:    wholeSeconds(rejection.Decision.RetryAfter),
+		CorrelationId: correlationId,
+	}
+
+	header := resp.Header()
+	header.Set(responder.config.CorrelationHeader, correlationId)
+	header.Add("Vary", "Accept")
+	switch negotiate(req.Header.Get("Accept"), "application/problem+json", "application/json", "text/html", "text/plain") {
+	case "text/html":
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		resp.WriteHeader(rejection.Status)
+		problemPage.Execute(resp, details)
+	case "text/plain":
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.WriteHeader(rejection.Status)
+		fmt.Fprintf(resp, "%s\nCorrelation ID: %s\n", details.Detail, correlationId)
+	default:
+		header.Set("Content-Type", "application/problem+json")
+		resp.WriteHeader(rejection.Status)
+		json.NewEncoder(resp).Encode(details)
+	}
+}
+
+func detail(rejection Rejection) string {
+	detail := "Throttle limit exceeded."
+	if rejection.Status == http.StatusServiceUnavailable {
+		detail = "Timed out waiting for capacity."
+	}
+	if retryAfter := wholeSeconds(rejection.Decision.RetryAfter); retryAfter > 0 {
+		detail += " Retry after " + strconv.FormatInt(retryAfter, 10) + " seconds."
+	}
+	return detail
+}
+
+var problemPage = template.Must(template.New("problem").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+<p>Correlation ID: <code>{{.CorrelationId}}</code></p>
+</body>
+</html>
+`))
+
+func newCorrelationId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The offered media type the Accept header prefers, ties going to whichever is offered
+// first. The first offer when nothing in the header is acceptable, since refusing to
+// explain a refusal helps nobody.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := quality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// the q of the most specific media range in accept matching offer
+func quality(accept string, offer string) float64 {
+	offerType, _, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		var rangeSpecificity int
+		switch name {
+		case offer:
+			rangeSpecificity = 2
+		case offerType + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		default:
+			continue
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+		specificity, q = rangeSpecificity, 1.0
+		for _, param := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+	}
+	return q
+}
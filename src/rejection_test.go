@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var refusal = fixedDecisions{Decision{
+	Allowed:    false,
+	Limit:      10,
+	ResetAt:    start.Add(3 * time.Second),
+	RetryAfter: 2500 * time.Millisecond,
+}}
+
+func reject(handler http.Handler, headers ...string) *httptest.ResponseRecorder {
+	servlet := Middleware(refusal, oneTenant, FixedRequestCost, WithRejection(handler))(http.HandlerFunc(okServlet))
+	resp := httptest.NewRecorder()
+	servlet.ServeHTTP(resp, requestWith("/", headers...))
+	return resp
+}
+
+func Test_rejections_are_plain_text_by_default(t *testing.T) {
+	resp := serve(refusal)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "Throttle limit exceeded.", resp.Body.String())
+}
+
+func Test_rejection_handlers_are_told_why(t *testing.T) {
+	var seen Rejection
+	resp := reject(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		seen, _ = RejectionFromContext(req.Context())
+		resp.WriteHeader(seen.Status)
+	}))
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "3", resp.Header().Get("Retry-After"))
+	assert.Equal(t, "tenant", seen.TenantId)
+	assert.Equal(t, refusal.decision, seen.Decision)
+}
+
+func Test_problem_details_are_served_to_api_clients(t *testing.T) {
+	resp := reject(ProblemResponder(ProblemConfig{}), "X-Request-ID", "req-1")
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "req-1", resp.Header().Get("X-Request-ID"))
+	var details map[string]any
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &details))
+	assert.Equal(t, map[string]any{
+		"type":           "about:blank",
+		"title":          "Too Many Requests",
+		"status":         429.0,
+		"detail":         "Throttle limit exceeded. Retry after 3 seconds.",
+		"tenant":         "tenant",
+		"limit":          10.0,
+		"retry_after":    3.0,
+		"correlation_id": "req-1",
+	}, details)
+}
+
+func Test_correlation_ids_are_generated_when_missing(t *testing.T) {
+	resp := reject(ProblemResponder(ProblemConfig{CorrelationHeader: "X-Trace"}))
+
+	id := resp.Header().Get("X-Trace")
+	assert.Len(t, id, 32)
+	assert.Contains(t, resp.Body.String(), id)
+}
+
+func Test_browsers_are_given_html_or_text(t *testing.T) {
+	responder := ProblemResponder(ProblemConfig{})
+
+	resp := reject(responder, "Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(resp.Body.String(), "<!DOCTYPE html>"))
+
+	resp = reject(responder, "Accept", "text/plain, application/json;q=0.5")
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(resp.Body.String(), "Throttle limit exceeded."))
+
+	resp = reject(responder, "Accept", "*/*")
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", resp.Header().Get("Vary"))
+}
+
+func Test_negotiation_prefers_the_most_specific_range(t *testing.T) {
+	offers := []string{"application/problem+json", "text/html", "text/plain"}
+
+	assert.Equal(t, "text/plain", negotiate("text/*;q=0.5, text/plain", offers...))
+	assert.Equal(t, "text/html", negotiate("text/*, text/plain;q=0.1", offers...))
+	assert.Equal(t, "application/problem+json", negotiate("image/png", offers...))
+	assert.Equal(t, "application/problem+json", negotiate("", offers...))
+}
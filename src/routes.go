@@ -0,0 +1,248 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// An endpoint and what requests to it cost.
+type Route struct {
+	// identifies the route to metrics and handlers, "METHOD pattern" when empty
+	Name string
+	// empty matches any method
+	Method string
+	// Slash separated segments, each of which is either literal, a {param} matching any
+	// one segment, or * matching any one segment. The last segment may also be a
+	// {param...} matching the rest of the path, or end in * to match any path with the
+	// preceding prefix, e.g. "/users/{id}/export", "/static/{file...}" or "/api/v1/*".
+	Pattern string
+	Cost    uint64
+	// Optional, a limit applying only to requests to this route, on top of the limiter
+	// given to Middleware. Key defaults to SameKey, charging the tenant's own quota for
+	// the route. The limiter must be an AdjustableRateLimiter, see Composite.
+	Limit Keyed
+}
+
+// What a request matched in a RouteTable.
+type RouteMatch struct {
+	Route *Route
+	// the position of Route in the table, for correlating it with the caller's own data
+	Index int
+	// the values of the route's {param}s
+	Params map[string]string
+}
+
+// Matches requests to routes in order, the first match wins.
+type RouteTable struct {
+	routes      []compiledRoute
+	defaultCost uint64
+}
+
+// Requests matching no route cost defaultCost.
+func NewRouteTable(defaultCost uint64, routes ...Route) (*RouteTable, error) {
+	table := &RouteTable{defaultCost: defaultCost, routes: make([]compiledRoute, 0, len(routes))}
+	for _, route := range routes {
+		segments, err := parsePattern(route.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if route.Name == "" {
+			route.Name = strings.TrimSpace(strings.ToUpper(route.Method) + " " + route.Pattern)
+		}
+		if route.Limit.Limiter != nil {
+			if _, ok := route.Limit.Limiter.(AdjustableRateLimiter); !ok {
+				return nil, fmt.Errorf("route %q: its limiter can't be refunded", route.Name)
+			}
+			if route.Limit.Key == nil {
+				route.Limit.Key = SameKey
+			}
+		}
+		table.routes = append(table.routes, compiledRoute{route: route, segments: segments})
+	}
+	return table, nil
+}
+
+// Charges a route's limit on top of the tenant's, see Route.Limit. Route limits can
+// always be refunded, so the tenant's limiter goes last when it can't be.
+func withRouteLimit(limiter RateLimiter, limit Keyed) RateLimiter {
+	members := []Keyed{{Limiter: limiter, Key: SameKey}, limit}
+	if _, ok := limiter.(AdjustableRateLimiter); !ok {
+		members[0], members[1] = members[1], members[0]
+	}
+	composite, _ := Composite(members...)
+	return composite
+}
+
+func (table *RouteTable) Match(req *http.Request) (RouteMatch, bool) {
+	for i := range table.routes {
+		compiled := &table.routes[i]
+		if compiled.route.Method != "" && !strings.EqualFold(compiled.route.Method, req.Method) {
+			continue
+		}
+		if params, ok := compiled.match(req.URL.Path); ok {
+			return RouteMatch{Route: &compiled.route, Index: i, Params: params}, true
+		}
+	}
+	return RouteMatch{}, false
+}
+
+// A cost function for Middleware. Under WithRoutes it reuses the match Middleware has
+// already made rather than matching again.
+func (table *RouteTable) Cost(req *http.Request) uint64 {
+	match, ok := RouteFromContext(req.Context())
+	if !ok {
+		match, ok = table.Match(req)
+	}
+	if ok {
+		return match.Route.Cost
+	}
+	return table.defaultCost
+}
+
+// Matches each request against the table before it is costed or limited, making the
+// match available through RouteFromContext and enforcing the matched route's Limit.
+func WithRoutes(table *RouteTable) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		config.routes = table
+	}
+}
+
+// The route matched by Middleware for the request currently being served, if any.
+func RouteFromContext(ctx context.Context) (RouteMatch, bool) {
+	match, ok := ctx.Value(routeKey{}).(RouteMatch)
+	return match, ok
+}
+
+type routeKey struct{}
+
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	paramSegment
+	wildcardSegment
+	// matches everything from here on which starts with the segment's text
+	restSegment
+)
+
+type patternSegment struct {
+	kind segmentKind
+	// the literal text, the param name, or the prefix of the rest
+	text string
+	// for a rest segment, the param to capture it into, if any
+	param string
+}
+
+type compiledRoute struct {
+	route    Route
+	segments []patternSegment
+}
+
+func parsePattern(pattern string) ([]patternSegment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("route pattern %q must begin with /", pattern)
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]patternSegment, 0, len(parts))
+	params := map[string]bool{}
+	for i, part := range parts {
+		last := i == len(parts)-1
+		var seg patternSegment
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			if !last {
+				return nil, fmt.Errorf("route pattern %q may only have a {param...} at the end", pattern)
+			}
+			seg = patternSegment{kind: restSegment, param: strings.TrimSuffix(part[1:], "...}")}
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			seg = patternSegment{kind: paramSegment, text: part[1 : len(part)-1]}
+		case part == "*" && !last:
+			seg = patternSegment{kind: wildcardSegment}
+		case last && strings.HasSuffix(part, "*"):
+			seg = patternSegment{kind: restSegment, text: strings.TrimSuffix(part, "*")}
+		default:
+			seg = patternSegment{kind: literalSegment, text: part}
+		}
+
+		name := seg.param
+		if seg.kind == paramSegment {
+			name = seg.text
+		}
+		if (seg.kind == paramSegment || seg.param != "") && !validParamName(name) {
+			return nil, fmt.Errorf("route pattern %q has an invalid param %q", pattern, part)
+		}
+		if name != "" {
+			if params[name] {
+				return nil, fmt.Errorf("route pattern %q repeats the param %q", pattern, name)
+			}
+			params[name] = true
+		}
+		if strings.ContainsAny(seg.text, "{}*") {
+			return nil, fmt.Errorf("route pattern %q has a malformed segment %q", pattern, part)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func validParamName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "{}*/.")
+}
+
+func (compiled *compiledRoute) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	remaining := path[1:]
+	var params map[string]string
+	capture := func(name string, value string) {
+		if params == nil {
+			params = map[string]string{}
+		}
+		params[name] = value
+	}
+
+	for i, seg := range compiled.segments {
+		if i > 0 {
+			rest, ok := strings.CutPrefix(remaining, "/")
+			if !ok {
+				return nil, false
+			}
+			remaining = rest
+		}
+
+		if seg.kind == restSegment {
+			if !strings.HasPrefix(remaining, seg.text) {
+				return nil, false
+			}
+			if seg.param != "" {
+				capture(seg.param, remaining)
+			}
+			return params, true
+		}
+
+		value := remaining
+		if end := strings.IndexByte(remaining, '/'); end >= 0 {
+			value = remaining[:end]
+		}
+		remaining = remaining[len(value):]
+		switch seg.kind {
+		case literalSegment:
+			if value != seg.text {
+				return nil, false
+			}
+		case paramSegment:
+			if value == "" {
+				return nil, false
+			}
+			capture(seg.text, value)
+		case wildcardSegment:
+			if value == "" {
+				return nil, false
+			}
+		}
+	}
+	return params, remaining == ""
+}
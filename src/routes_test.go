@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func routeTable(t *testing.T, routes ...Route) *RouteTable {
+	table, err := NewRouteTable(1, routes...)
+	assert.NoError(t, err)
+	return table
+}
+
+func matched(table *RouteTable, method string, path string) (string, map[string]string) {
+	match, ok := table.Match(httptest.NewRequest(method, path, nil))
+	if !ok {
+		return "", nil
+	}
+	return match.Route.Name, match.Params
+}
+
+func Test_routes_match_methods_and_literal_paths(t *testing.T) {
+	table := routeTable(t,
+		Route{Method: "POST", Pattern: "/export", Cost: 50},
+		Route{Name: "health", Pattern: "/health", Cost: 0},
+		Route{Pattern: "/", Cost: 2},
+	)
+
+	name, _ := matched(table, "POST", "/export")
+	assert.Equal(t, "POST /export", name)
+	name, _ = matched(table, "GET", "/export")
+	assert.Equal(t, "", name)
+	name, _ = matched(table, "HEAD", "/health")
+	assert.Equal(t, "health", name)
+	name, _ = matched(table, "GET", "/")
+	assert.Equal(t, "/", name)
+	name, _ = matched(table, "GET", "/health/")
+	assert.Equal(t, "", name)
+
+	assert.Equal(t, uint64(50), table.Cost(httptest.NewRequest("POST", "/export", nil)))
+	assert.Equal(t, uint64(0), table.Cost(httptest.NewRequest("GET", "/health", nil)))
+	assert.Equal(t, uint64(1), table.Cost(httptest.NewRequest("GET", "/elsewhere", nil)))
+}
+
+func Test_routes_capture_params(t *testing.T) {
+	table := routeTable(t,
+		Route{Name: "export", Pattern: "/users/{id}/export"},
+		Route{Name: "one", Pattern: "/users/*"},
+		Route{Name: "files", Pattern: "/static/{file...}"},
+	)
+
+	name, params := matched(table, "GET", "/users/42/export")
+	assert.Equal(t, "export", name)
+	assert.Equal(t, map[string]string{"id": "42"}, params)
+
+	name, _ = matched(table, "GET", "/users//export")
+	assert.Equal(t, "one", name, "params may not be empty, so this falls through to the prefix")
+
+	name, params = matched(table, "GET", "/static/css/site.css")
+	assert.Equal(t, "files", name)
+	assert.Equal(t, map[string]string{"file": "css/site.css"}, params)
+}
+
+func Test_wildcards_match_one_segment_or_the_rest(t *testing.T) {
+	table := routeTable(t,
+		Route{Name: "middle", Pattern: "/orgs/*/members"},
+		Route{Name: "prefix", Pattern: "/api/v1*"},
+	)
+
+	name, _ := matched(table, "GET", "/orgs/acme/members")
+	assert.Equal(t, "middle", name)
+	name, _ = matched(table, "GET", "/orgs/acme/x/members")
+	assert.Equal(t, "", name)
+	name, _ = matched(table, "GET", "/api/v1")
+	assert.Equal(t, "prefix", name)
+	name, _ = matched(table, "GET", "/api/v1beta/things")
+	assert.Equal(t, "prefix", name)
+	name, _ = matched(table, "GET", "/api/v2")
+	assert.Equal(t, "", name)
+}
+
+func Test_malformed_patterns_are_refused(t *testing.T) {
+	for _, pattern := range []string{"export", "/a/{rest...}/b", "/{}", "/{a}/{a}", "/a*b/c", "/{a"} {
+		_, err := NewRouteTable(1, Route{Pattern: pattern})
+		assert.Error(t, err, pattern)
+	}
+}
+
+func Test_middleware_shares_the_matched_route(t *testing.T) {
+	table := routeTable(t, Route{Name: "export", Method: "POST", Pattern: "/users/{id}/export", Cost: 50})
+	var seen RouteMatch
+	servlet := Middleware(fixedDecisions{Decision{Allowed: true}}, UniqueTenantIdentifier, table.Cost, WithRoutes(table))(
+		http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			seen, _ = RouteFromContext(req.Context())
+		}))
+
+	servlet.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users/7/export", nil))
+	assert.Equal(t, "export", seen.Route.Name)
+	assert.Equal(t, "7", seen.Params["id"])
+}
+
+func Test_routes_may_carry_their_own_limits(t *testing.T) {
+	tenantLimit := newCountingLimiter(1000)
+	exportLimit := newCountingLimiter(100)
+	table := routeTable(t, Route{Pattern: "/export", Cost: 50, Limit: Keyed{Limiter: exportLimit}})
+	servlet := Middleware(tenantLimit, UniqueTenantIdentifier, table.Cost, WithRoutes(table))(http.HandlerFunc(okServlet))
+	status := func(path string) int {
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("/export"))
+	assert.Equal(t, http.StatusOK, status("/export"))
+	assert.Equal(t, http.StatusTooManyRequests, status("/export"))
+	assert.Equal(t, http.StatusOK, status("/other"))
+
+	// the refused export was refunded to the tenant's own quota
+	assert.Equal(t, uint64(101), tenantLimit.used["192.0.2.1:1234"])
+	assert.Equal(t, uint64(100), exportLimit.used["192.0.2.1:1234"])
+}
+
+func Test_route_limits_must_be_refundable(t *testing.T) {
+	_, err := NewRouteTable(1, Route{Pattern: "/export", Limit: Keyed{Limiter: fixedDecisions{}}})
+	assert.Error(t, err)
+}
+
+func Test_unrefundable_tenant_limits_are_charged_after_the_route_limit(t *testing.T) {
+	exportLimit := newCountingLimiter(100)
+	table := routeTable(t, Route{Pattern: "/export", Cost: 50, Limit: Keyed{Limiter: exportLimit}})
+	servlet := Middleware(fixedDecisions{Decision{Allowed: false}}, UniqueTenantIdentifier, table.Cost,
+		WithRoutes(table))(http.HandlerFunc(okServlet))
+
+	resp := httptest.NewRecorder()
+	servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/export", nil))
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	// the tenant's refusal came last, and the route's charge was refunded
+	assert.Equal(t, uint64(0), exportLimit.used["192.0.2.1:1234"])
+}
+
+// admits everything, noting the priority of each request
+type priorityRecorder struct {
+	seen []Priority
+}
+
+// nothing is ever charged, so there's nothing to refund
+func (limiter *priorityRecorder) AdjustCost(userId string, delta int64) {}
+
+func (limiter *priorityRecorder) AttemptAccess(userId string, requestCost uint64) bool {
+	return limiter.Decide(userId, requestCost).Allowed
+}
+
+func (limiter *priorityRecorder) Decide(userId string, requestCost uint64) Decision {
+	return limiter.DecideWithPriority(userId, requestCost, DefaultPriority)
+}
+
+func (limiter *priorityRecorder) DecideWithPriority(userId string, requestCost uint64, priority Priority) Decision {
+	limiter.seen = append(limiter.seen, priority)
+	return Decision{Allowed: true}
+}
+
+func Test_routes_with_their_own_limits_are_still_prioritised(t *testing.T) {
+	tenantLimit := &priorityRecorder{}
+	exportLimit := &priorityRecorder{}
+	table := routeTable(t, Route{Pattern: "/export", Limit: Keyed{Limiter: exportLimit}})
+	servlet := Middleware(tenantLimit, UniqueTenantIdentifier, table.Cost,
+		WithRoutes(table), WithPriority(PriorityFromHeader("X-Priority")))(http.HandlerFunc(okServlet))
+
+	req := httptest.NewRequest("GET", "/export", nil)
+	req.Header.Set("X-Priority", "sheddable")
+	servlet.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, []Priority{SheddablePriority}, tenantLimit.seen)
+	assert.Equal(t, []Priority{SheddablePriority}, exportLimit.seen)
+}
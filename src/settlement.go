@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Records the true cost of the request being served. Middleware charges the tenant
+// the difference from its up front estimate once the handler returns, so this may be
+// called at any point during the request, and as often as needed; the last call wins.
+//
+// Returns false if there is nothing to settle with, either because the request was not
+// served through Middleware or because its RateLimiter is not an AdjustableRateLimiter.
+func SetActualCost(ctx context.Context, actualCost uint64) bool {
+	settlement, ok := ctx.Value(costSettlementKey{}).(*costSettlement)
+	if !ok {
+		return false
+	}
+	settlement.actual.Store(actualCost)
+	settlement.known.Store(true)
+	return true
+}
+
+type costSettlementKey struct{}
+
+type costSettlement struct {
+	estimate uint64
+	actual   atomic.Uint64
+	known    atomic.Bool
+}
+
+func (settlement *costSettlement) settle(limiter AdjustableRateLimiter, tenantId string) {
+	if !settlement.known.Load() {
+		return
+	}
+	delta := int64(settlement.actual.Load()) - int64(settlement.estimate)
+	if delta != 0 {
+		limiter.AdjustCost(tenantId, delta)
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A limiter consulted alongside the middleware's own but never enforced, for seeing
+// who a new limit would refuse before it is rolled out. It keeps its own buckets, so
+// the real limiter is not charged on its behalf, e.g. to run an old and a new policy
+// side by side.
+type Shadow struct {
+	Limiter RateLimiter
+	// nil charges the shadow whatever the middleware's own limiter is charged
+	Cost func(req *http.Request) uint64
+	// called for each request the shadow would have refused, LogRejections to StdOutLogger when nil
+	Report func(req *http.Request, rejection Rejection)
+}
+
+// May be given more than once, to evaluate several shadows.
+func WithShadow(shadow Shadow) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		if shadow.Report == nil {
+			shadow.Report = LogRejections(StdOutLogger{})
+		}
+		config.shadows = append(config.shadows, shadow)
+	}
+}
+
+// Evaluates the middleware's own limiter but serves every request regardless, reporting
+// those it would have refused, LogRejections to StdOutLogger when report is nil.
+//
+// Clients see no sign of the limiter: rate limit headers are not written, nothing is
+// queued, and WithByteMetering is ignored. Requests which would have been refused are
+// not charged, just as they wouldn't be were the limit enforced, so that the limiter
+// accurately tracks who would be refused.
+func WithDryRun(report func(req *http.Request, rejection Rejection)) MiddlewareOption {
+	return func(config *middlewareConfig) {
+		if report == nil {
+			report = LogRejections(StdOutLogger{})
+		}
+		config.dryRun = report
+	}
+}
+
+// Reports rejections which were not enforced as errors to the given logger.
+func LogRejections(logger Logger) func(req *http.Request, rejection Rejection) {
+	return func(req *http.Request, rejection Rejection) {
+		logger.Error(fmt.Sprintf(
+			"rate limit not enforced: would have refused tenant %q for %s %s, retry after %s\n",
+			rejection.TenantId, req.Method, req.URL.Path, rejection.Decision.RetryAfter,
+		))
+	}
+}
+
+func (config *middlewareConfig) evaluateShadows(req *http.Request, tenantId string, estimate uint64) {
+	for _, shadow := range config.shadows {
+		cost := estimate
+		if shadow.Cost != nil {
+			cost = shadow.Cost(req)
+		}
+		if decision := Decide(shadow.Limiter, tenantId, cost); !decision.Allowed {
+			shadow.Report(req, Rejection{TenantId: tenantId, Status: http.StatusTooManyRequests, Decision: decision})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src/test_logger"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type reported struct {
+	rejections []Rejection
+}
+
+func (r *reported) report(req *http.Request, rejection Rejection) {
+	r.rejections = append(r.rejections, rejection)
+}
+
+func Test_dry_runs_serve_every_request(t *testing.T) {
+	limiter := newCountingLimiter(2)
+	var reports reported
+	servlet := Middleware(limiter, oneTenant, FixedRequestCost, WithHeaders(LegacyHeaders), WithDryRun(reports.report))(http.HandlerFunc(okServlet))
+
+	for i := 0; i < 5; i++ {
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Empty(t, resp.Header())
+	}
+
+	assert.Len(t, reports.rejections, 3)
+	assert.Equal(t, "tenant", reports.rejections[0].TenantId)
+	// refused requests are not charged, as they wouldn't be if refused for real
+	assert.Equal(t, uint64(2), limiter.used["tenant"])
+}
+
+func Test_shadows_keep_their_own_buckets(t *testing.T) {
+	enforced := newCountingLimiter(3)
+	shadow := newCountingLimiter(1)
+	var reports reported
+	servlet := Middleware(enforced, oneTenant, FixedRequestCost, WithShadow(Shadow{
+		Limiter: shadow,
+		Cost: func(req *http.Request) uint64 {
+			return 0
+		},
+		Report: reports.report,
+	}), WithShadow(Shadow{Limiter: newCountingLimiter(2), Report: reports.report}))(http.HandlerFunc(okServlet))
+	status := func() int {
+		resp := httptest.NewRecorder()
+		servlet.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+		return resp.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status())
+	assert.Equal(t, http.StatusOK, status())
+	assert.Equal(t, http.StatusOK, status())
+	assert.Equal(t, http.StatusTooManyRequests, status())
+
+	// the free shadow never refuses, the other refuses the third request onwards
+	assert.Len(t, reports.rejections, 2)
+	assert.Equal(t, uint64(0), shadow.used["tenant"])
+	assert.Equal(t, uint64(3), enforced.used["tenant"])
+}
+
+func Test_unenforced_rejections_may_be_logged(t *testing.T) {
+	log := &test_logger.LineLogger{}
+	LogRejections(log)(httptest.NewRequest("POST", "/export", nil), Rejection{TenantId: "acme", Decision: Decision{RetryAfter: 1500 * time.Millisecond}})
+
+	assert.Equal(t, []string{"rate limit not enforced: would have refused tenant \"acme\" for POST /export, retry after 1.5s\n"}, log.Lines)
+}
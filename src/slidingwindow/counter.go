@@ -0,0 +1,209 @@
+package slidingwindow
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"math"
+	"time"
+)
+
+// A ring buffer of per-slot cost totals. The slot under current covers the epoch
+// containing the present, and one slot beyond a full window is kept so that the
+// portion of it still overlapping the window can be counted.
+type slotCounter struct {
+	counts  []uint64
+	current ratelimit.ModuloRel
+	// the epoch number of the current slot, i.e. unix nanos / width
+	epoch int64
+	width time.Duration
+}
+
+func newSlotCounter(slots int) *slotCounter {
+	return &slotCounter{
+		counts:  make([]uint64, slots+1),
+		current: ratelimit.ModuloRel{Value: 0, Mod: slots + 1},
+	}
+}
+
+func (counter *slotCounter) slots() int {
+	return len(counter.counts) - 1
+}
+
+func (counter *slotCounter) attempt(now time.Time, limit *TenantLimit, accessCost uint64) ratelimit.Decision {
+	counter.advance(now, limit)
+
+	used := counter.estimate(now)
+	allowed := used+float64(accessCost) <= float64(limit.Limit)
+	if allowed {
+		counter.counts[counter.current.Value] += accessCost
+		used += float64(accessCost)
+	}
+
+	decision := ratelimit.Decision{
+		Allowed:   allowed,
+		Remaining: uint64(math.Max(0, math.Floor(float64(limit.Limit)-used))),
+		Limit:     limit.Limit,
+		Window:    limit.Window,
+		ResetAt:   counter.resetAt(now),
+	}
+	if !allowed {
+		decision.RetryAfter = counter.retryAfter(now, limit, accessCost)
+	}
+	return decision
+}
+
+func (counter *slotCounter) adjust(now time.Time, limit *TenantLimit, delta int64) {
+	counter.advance(now, limit)
+
+	if delta >= 0 {
+		counter.counts[counter.current.Value] += uint64(delta)
+		return
+	}
+
+	// refunds are taken from the most recent slots, they're the ones being settled
+	refund := uint64(-delta)
+	slot := counter.current
+	for i := 0; i <= counter.slots() && refund > 0; i++ {
+		taken := min(refund, counter.counts[slot.Value])
+		counter.counts[slot.Value] -= taken
+		refund -= taken
+		slot = slot.Decrement()
+	}
+}
+
+// rotates out any slots which have fallen out of the window since the last access
+func (counter *slotCounter) advance(now time.Time, limit *TenantLimit) {
+	width := max(limit.Window/time.Duration(counter.slots()), 1)
+
+	if counter.width == 0 {
+		// the first access
+		counter.width = width
+		counter.epoch = now.UnixNano() / int64(width)
+		return
+	}
+
+	counter.rotate(now.UnixNano() / int64(counter.width))
+	if width != counter.width {
+		counter.rescale(now, width)
+	}
+}
+
+func (counter *slotCounter) rotate(epoch int64) {
+	// clocks which step backwards are treated as standing still
+	steps := min(epoch-counter.epoch, int64(len(counter.counts)))
+	for i := int64(0); i < steps; i++ {
+		counter.current = counter.current.Increment()
+		counter.counts[counter.current.Value] = 0
+	}
+	counter.epoch = max(epoch, counter.epoch)
+}
+
+// The tenant's window has changed, so the counts are spread over slots of the new width
+// as though each slot's cost had been spent evenly up until now. History which no longer
+// fits inside the new window is forgotten, the rest still counts against the tenant.
+func (counter *slotCounter) rescale(now time.Time, width time.Duration) {
+	present := now.UnixNano()
+	epoch := present / int64(width)
+
+	scaled := make([]float64, len(counter.counts))
+	for back := 0; back <= counter.slots(); back++ {
+		count := float64(counter.counts[counter.current.Add(-back).Value])
+		if count == 0 {
+			continue
+		}
+		from := (counter.epoch - int64(back)) * int64(counter.width)
+		to := min(from+int64(counter.width), present)
+		if to <= from {
+			// spent at the very start of the current slot, or the clock has stepped backwards
+			if slot := epoch - to/int64(width); slot >= 0 && slot < int64(len(scaled)) {
+				scaled[slot] += count
+			}
+			continue
+		}
+		for slot := range scaled {
+			slotFrom := (epoch - int64(slot)) * int64(width)
+			overlap := min(to, slotFrom+int64(width)) - max(from, slotFrom)
+			if overlap > 0 {
+				scaled[slot] += count * float64(overlap) / float64(to-from)
+			}
+		}
+	}
+
+	for slot, count := range scaled {
+		counter.counts[counter.current.Add(-slot).Value] = uint64(math.Round(count))
+	}
+	counter.width = width
+	counter.epoch = epoch
+}
+
+// the full slots inside the window, plus the fraction of the oldest slot still overlapping it
+func (counter *slotCounter) estimate(now time.Time) float64 {
+	elapsed := counter.elapsed(now)
+	full := counter.sum(0, counter.slots()-1)
+	oldest := counter.counts[counter.current.Add(-counter.slots()).Value]
+	return float64(full) + (1-elapsed)*float64(oldest)
+}
+
+// the fraction of the current slot which has passed
+func (counter *slotCounter) elapsed(now time.Time) float64 {
+	into := now.UnixNano() - counter.epoch*int64(counter.width)
+	return math.Min(1, math.Max(0, float64(into)/float64(counter.width)))
+}
+
+// total cost of the slots from nearer to further back, inclusive, relative to the current slot
+func (counter *slotCounter) sum(nearer int, further int) uint64 {
+	total := uint64(0)
+	for back := nearer; back <= further; back++ {
+		total += counter.counts[counter.current.Add(-back).Value]
+	}
+	return total
+}
+
+func (counter *slotCounter) epochStart(epoch int64) time.Time {
+	return time.Unix(0, epoch*int64(counter.width))
+}
+
+// a slot stops counting once the window has moved a full slot past it
+func (counter *slotCounter) resetAt(now time.Time) time.Time {
+	for back := 0; back <= counter.slots(); back++ {
+		if counter.counts[counter.current.Add(-back).Value] > 0 {
+			epoch := counter.epoch - int64(back)
+			return counter.epochStart(epoch + int64(counter.slots()) + 1).In(now.Location())
+		}
+	}
+	return now
+}
+
+// Walks forward one slot at a time. Within a slot the estimate falls linearly as the
+// oldest slot slides out of the window, so the moment it admits accessCost can be solved for.
+func (counter *slotCounter) retryAfter(now time.Time, limit *TenantLimit, accessCost uint64) time.Duration {
+	if accessCost > limit.Limit {
+		// the request can never fit, the best advice we have is to wait for an empty window
+		return counter.resetAt(now).Sub(now)
+	}
+
+	slots := counter.slots()
+	for ahead := 0; ahead <= slots; ahead++ {
+		full := counter.sum(0, slots-1-ahead)
+		oldest := counter.counts[counter.current.Add(ahead-slots).Value]
+		if full+accessCost > limit.Limit {
+			continue
+		}
+
+		fraction := 0.0
+		if ahead == 0 {
+			fraction = counter.elapsed(now)
+		}
+		if oldest > 0 {
+			needed := 1 - float64(limit.Limit-accessCost-full)/float64(oldest)
+			fraction = math.Max(fraction, needed)
+		}
+		if fraction >= 1 {
+			continue
+		}
+
+		offset := time.Duration(math.Ceil(fraction * float64(counter.width)))
+		at := counter.epochStart(counter.epoch + int64(ahead)).Add(offset)
+		return max(at.Sub(now), 0)
+	}
+	return counter.resetAt(now).Sub(now)
+}
@@ -0,0 +1,136 @@
+package slidingwindow
+
+import (
+	"github.com/npxcomplete/http-rate-limit/src"
+	"time"
+)
+
+const initialLogCapacity = 8
+
+type logEntry struct {
+	at   time.Time
+	cost uint64
+}
+
+// A ring buffer of every access still inside the window, oldest first.
+type accessLog struct {
+	entries []logEntry
+	oldest  ratelimit.ModuloRel
+	size    int
+	// the sum of every entry's cost
+	used uint64
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{
+		entries: make([]logEntry, initialLogCapacity),
+		oldest:  ratelimit.ModuloRel{Value: 0, Mod: initialLogCapacity},
+	}
+}
+
+func (log *accessLog) attempt(now time.Time, limit *TenantLimit, accessCost uint64) ratelimit.Decision {
+	log.expire(now, limit.Window)
+
+	allowed := log.used+accessCost <= limit.Limit
+	if allowed {
+		log.append(now, accessCost)
+	}
+
+	decision := ratelimit.Decision{
+		Allowed: allowed,
+		Limit:   limit.Limit,
+		Window:  limit.Window,
+		ResetAt: log.resetAt(now, limit.Window),
+	}
+	if log.used < limit.Limit {
+		decision.Remaining = limit.Limit - log.used
+	}
+	if !allowed {
+		decision.RetryAfter = log.retryAfter(now, limit, accessCost)
+	}
+	return decision
+}
+
+func (log *accessLog) adjust(now time.Time, limit *TenantLimit, delta int64) {
+	log.expire(now, limit.Window)
+
+	if delta >= 0 {
+		log.append(now, uint64(delta))
+		return
+	}
+
+	// refunds are taken from the most recent accesses, they're the ones being settled
+	refund := uint64(-delta)
+	for log.size > 0 && refund > 0 {
+		newest := &log.entries[log.oldest.Add(log.size-1).Value]
+		if newest.cost > refund {
+			newest.cost -= refund
+			log.used -= refund
+			return
+		}
+		refund -= newest.cost
+		log.used -= newest.cost
+		*newest = logEntry{}
+		log.size--
+	}
+}
+
+func (log *accessLog) expire(now time.Time, window time.Duration) {
+	for log.size > 0 {
+		entry := log.entries[log.oldest.Value]
+		if now.Sub(entry.at) < window {
+			return
+		}
+		log.used -= entry.cost
+		log.entries[log.oldest.Value] = logEntry{}
+		log.oldest = log.oldest.Increment()
+		log.size--
+	}
+}
+
+func (log *accessLog) append(now time.Time, cost uint64) {
+	if cost == 0 {
+		return
+	}
+	if log.size == len(log.entries) {
+		log.grow()
+	}
+	log.entries[log.oldest.Add(log.size).Value] = logEntry{at: now, cost: cost}
+	log.size++
+	log.used += cost
+}
+
+func (log *accessLog) grow() {
+	entries := make([]logEntry, 2*len(log.entries))
+	for i := 0; i < log.size; i++ {
+		entries[i] = log.entries[log.oldest.Add(i).Value]
+	}
+	log.entries = entries
+	log.oldest = ratelimit.ModuloRel{Value: 0, Mod: len(entries)}
+}
+
+// when the newest entry leaves the window
+func (log *accessLog) resetAt(now time.Time, window time.Duration) time.Time {
+	if log.size == 0 {
+		return now
+	}
+	return log.entries[log.oldest.Add(log.size-1).Value].at.Add(window)
+}
+
+// when enough of the oldest entries will have left the window to make room for accessCost
+func (log *accessLog) retryAfter(now time.Time, limit *TenantLimit, accessCost uint64) time.Duration {
+	if accessCost > limit.Limit {
+		// the request can never fit, the best advice we have is to wait for an empty window
+		return log.resetAt(now, limit.Window).Sub(now)
+	}
+
+	freed := uint64(0)
+	for i := 0; i < log.size; i++ {
+		entry := log.entries[log.oldest.Add(i).Value]
+		freed += entry.cost
+		if log.used-freed+accessCost <= limit.Limit {
+			return entry.at.Add(limit.Window).Sub(now)
+		}
+	}
+	return log.resetAt(now, limit.Window).Sub(now)
+}
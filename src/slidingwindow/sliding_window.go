@@ -0,0 +1,129 @@
+package slidingwindow
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"github.com/npxcomplete/http-rate-limit/src"
+	"sync"
+	"time"
+)
+
+// No more than Limit units of cost in any rolling Window.
+type TenantLimit struct {
+	Limit  uint64
+	Window time.Duration
+}
+
+type Config struct {
+	TenantCapacity int
+	Tenancy        func(tenant string) *TenantLimit
+
+	// Only used by the counter limiter: how many slots each window is divided into.
+	// More slots approximate the log more closely at the cost of memory. Defaults to 10.
+	Slots int
+}
+
+const defaultSlots = 10
+
+// Remembers every access within the window, so it enforces the limit exactly.
+// Memory per tenant grows with the number of accesses in a window.
+func NewLogRateLimiter(
+	config Config,
+) *slidingWindowRateLimiter {
+	return newRateLimiter(config, func() window {
+		return newAccessLog()
+	})
+}
+
+// Counts accesses in fixed slots and weights the oldest slot by how much of it still
+// overlaps the window. Constant memory per tenant, but only approximates the limit.
+func NewCounterRateLimiter(
+	config Config,
+) *slidingWindowRateLimiter {
+	if config.Slots <= 0 {
+		config.Slots = defaultSlots
+	}
+	return newRateLimiter(config, func() window {
+		return newSlotCounter(config.Slots)
+	})
+}
+
+func newRateLimiter(config Config, newWindow func() window) *slidingWindowRateLimiter {
+	return &slidingWindowRateLimiter{
+		cache:     NewStringWindowCache(config.TenantCapacity),
+		clock:     ratelimit.HardwareClock{},
+		config:    &config,
+		newWindow: newWindow,
+	}
+}
+
+var _ ratelimit.DecidingRateLimiter = &slidingWindowRateLimiter{}
+var _ ratelimit.AdjustableRateLimiter = &slidingWindowRateLimiter{}
+
+type slidingWindowRateLimiter struct {
+	// Use a fixed capacity cache to memory bound our Rate limiter
+	// Consequence: Only the noisiest N clients will be Rate limited.
+	cache StringWindowCache
+
+	// for testing algorithms involving time we need a mockable time source
+	clock ratelimit.Clock
+
+	config *Config
+
+	newWindow func() window
+}
+
+type StringWindowCache interface {
+	Put(key string, value *windowControlBlock) *windowControlBlock
+	Get(key string) (result *windowControlBlock, err error)
+}
+
+// the bookkeeping which distinguishes the log from the counter
+type window interface {
+	attempt(now time.Time, limit *TenantLimit, accessCost uint64) ratelimit.Decision
+	// unconditionally record (or for negative deltas, forget) cost
+	adjust(now time.Time, limit *TenantLimit, delta int64)
+}
+
+type windowControlBlock struct {
+	mutex  sync.Mutex
+	window window
+}
+
+func (limiter *slidingWindowRateLimiter) AttemptAccess(tenantId string, accessCost uint64) bool {
+	return limiter.Decide(tenantId, accessCost).Allowed
+}
+
+func (limiter *slidingWindowRateLimiter) Decide(tenantId string, accessCost uint64) ratelimit.Decision {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return ratelimit.Decision{Allowed: false}
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.window.attempt(limiter.clock.Now(), limiter.config.Tenancy(tenantId), accessCost)
+}
+
+func (limiter *slidingWindowRateLimiter) AdjustCost(tenantId string, delta int64) {
+	cb, err := limiter.controlBlock(tenantId)
+	if err != nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.window.adjust(limiter.clock.Now(), limiter.config.Tenancy(tenantId), delta)
+}
+
+func (limiter *slidingWindowRateLimiter) controlBlock(tenantId string) (*windowControlBlock, error) {
+	cb, err := limiter.cache.Get(tenantId)
+	if err == caches.MissingValueError {
+		cb = &windowControlBlock{
+			window: limiter.newWindow(),
+		}
+		limiter.cache.Put(tenantId, cb)
+	} else if err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
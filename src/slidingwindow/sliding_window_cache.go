@@ -0,0 +1,39 @@
+package slidingwindow
+
+import (
+	caches "github.com/npxcomplete/caches/src"
+	"sync"
+)
+
+func NewStringWindowCache(capacity int) privateStringWindowCache {
+	return WrapStringWindowCache(caches.NewLRUCache(capacity))
+}
+
+func WrapStringWindowCache(cache caches.Interface) privateStringWindowCache {
+	return privateStringWindowCache{
+		generic: cache,
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+type privateStringWindowCache struct {
+	mutex   *sync.RWMutex
+	generic caches.Interface
+}
+
+// see caches.Interface for contract
+func (cache privateStringWindowCache) Put(key string, value *windowControlBlock) *windowControlBlock {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	result, _ := cache.generic.Put(key, value).(*windowControlBlock)
+	return result
+}
+
+// see caches.Interface for contract
+func (cache privateStringWindowCache) Get(key string) (result *windowControlBlock, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	value, err := cache.generic.Get(key)
+	result, _ = value.(*windowControlBlock)
+	return
+}
@@ -0,0 +1,131 @@
+package slidingwindow
+
+import (
+	"bytes"
+	ratelimit "github.com/npxcomplete/http-rate-limit/src"
+	"github.com/npxcomplete/http-rate-limit/src/test_clocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2000, 3, 12, 10, 10, 0, 0, time.UTC)
+
+func tenPerMinute(tenant string) *TenantLimit {
+	return &TenantLimit{Limit: 10, Window: time.Minute}
+}
+
+func Test_smoke_test_happy_path_with_http(t *testing.T) {
+	for _, limiter := range []*slidingWindowRateLimiter{
+		NewLogRateLimiter(Config{Tenancy: tenPerMinute, TenantCapacity: 1}),
+		NewCounterRateLimiter(Config{Tenancy: tenPerMinute, TenantCapacity: 1}),
+	} {
+		limiter.clock = test_clocks.FixedClock{T: start}
+
+		limitedServlet := ratelimit.StdMiddleware(limiter)(
+			http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+				resp.WriteHeader(http.StatusOK)
+			}),
+		)
+
+		req := httptest.NewRequest("GET", "/path/to/resource", &bytes.Buffer{})
+		for i := 0; i < 10; i++ {
+			resp := httptest.NewRecorder()
+			limitedServlet.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+		}
+
+		resp := httptest.NewRecorder()
+		limitedServlet.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	}
+}
+
+func Test_the_log_enforces_any_rolling_window_exactly(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewLogRateLimiter(Config{Tenancy: tenPerMinute, TenantCapacity: 1})
+	limiter.clock = clock
+
+	// spread across more entries than the log initially holds
+	for i := 0; i < 10; i++ {
+		assert.True(t, limiter.AttemptAccess("tenant", 1))
+		clock.Advance(5 * time.Second)
+	}
+
+	decision := limiter.Decide("tenant", 3)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, uint64(0), decision.Remaining)
+	assert.Equal(t, 20*time.Second, decision.RetryAfter)
+	assert.Equal(t, start.Add(105*time.Second), decision.ResetAt)
+
+	clock.Advance(decision.RetryAfter - time.Nanosecond)
+	assert.False(t, limiter.AttemptAccess("tenant", 3))
+	clock.Advance(time.Nanosecond)
+	assert.True(t, limiter.AttemptAccess("tenant", 3))
+}
+
+func Test_the_log_settles_adjustments_against_recent_entries(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewLogRateLimiter(Config{Tenancy: tenPerMinute, TenantCapacity: 1})
+	limiter.clock = clock
+
+	assert.True(t, limiter.AttemptAccess("tenant", 4))
+	limiter.AdjustCost("tenant", 10)
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	limiter.AdjustCost("tenant", -12)
+	assert.True(t, limiter.AttemptAccess("tenant", 8))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+}
+
+func Test_the_counter_weights_the_slot_sliding_out_of_the_window(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limiter := NewCounterRateLimiter(Config{Tenancy: tenPerMinute, TenantCapacity: 1, Slots: 6})
+	limiter.clock = clock
+
+	assert.True(t, limiter.AttemptAccess("tenant", 10))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	// a full window later the first slot is still entirely inside the window
+	clock.Advance(time.Minute)
+	decision := limiter.Decide("tenant", 4)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 4*time.Second, decision.RetryAfter)
+	assert.Equal(t, start.Add(70*time.Second), decision.ResetAt)
+
+	// and four tenths of the way through the next slot, four tenths of it has left
+	clock.Advance(decision.RetryAfter)
+	assert.True(t, limiter.AttemptAccess("tenant", 4))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+
+	clock.Advance(10 * time.Second)
+	assert.True(t, limiter.AttemptAccess("tenant", 6))
+}
+
+func Test_the_counter_rescales_its_history_when_the_window_changes(t *testing.T) {
+	clock := &test_clocks.ManualClock{T: start}
+	limit := &TenantLimit{Limit: 10, Window: time.Minute}
+	limiter := NewCounterRateLimiter(Config{
+		Tenancy:        func(tenant string) *TenantLimit { return limit },
+		TenantCapacity: 1,
+		Slots:          6,
+	})
+	limiter.clock = clock
+
+	assert.True(t, limiter.AttemptAccess("tenant", 4))
+	clock.Advance(30 * time.Second)
+	assert.True(t, limiter.AttemptAccess("tenant", 4))
+	clock.Advance(5 * time.Second)
+
+	// halving the window keeps the recent slot, and the half of the first still inside it
+	limit = &TenantLimit{Limit: 10, Window: 30 * time.Second}
+	assert.False(t, limiter.AttemptAccess("tenant", 5))
+	assert.True(t, limiter.AttemptAccess("tenant", 4))
+
+	// while widening it keeps everything, though what was forgotten stays forgotten
+	limit = &TenantLimit{Limit: 20, Window: 2 * time.Minute}
+	assert.True(t, limiter.AttemptAccess("tenant", 10))
+	assert.False(t, limiter.AttemptAccess("tenant", 1))
+}
@@ -0,0 +1,32 @@
+package test_clocks
+
+import (
+	"sync"
+	"time"
+)
+
+// Only moves when told to, safe to share between goroutines.
+type ManualClock struct {
+	mutex sync.Mutex
+	T     time.Time
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.T
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.T = c.T.Add(d)
+}
+
+// A drop-in for time.After which advances the clock instead of sleeping.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ready := make(chan time.Time, 1)
+	ready <- c.Now()
+	return ready
+}
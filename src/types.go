@@ -1,8 +1,8 @@
 package ratelimit
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"net/http"
 	"time"
 )
@@ -13,6 +13,57 @@ type RateLimiter interface {
 	AttemptAccess(userId string, requestCost uint64) bool
 }
 
+// A RateLimiter which can explain itself. Decide consumes quota exactly as
+// AttemptAccess would, but reports the state of the tenant's quota alongside the verdict.
+type DecidingRateLimiter interface {
+	RateLimiter
+	Decide(userId string, requestCost uint64) Decision
+}
+
+type Decision struct {
+	Allowed bool
+	// whole units of cost still available to the tenant after this decision
+	Remaining uint64
+	// the most the tenant could ever spend at once
+	Limit uint64
+	// how long an exhausted quota takes to fully replenish
+	Window time.Duration
+	// when the tenant's quota will be fully replenished, assuming no further access
+	ResetAt time.Time
+	// zero when allowed, otherwise how long until the same request could succeed
+	RetryAfter time.Duration
+}
+
+// A RateLimiter which can settle a charge after the fact, for requests whose true cost
+// is only known once they have been served. Positive deltas charge the tenant more,
+// negative deltas refund them.
+type AdjustableRateLimiter interface {
+	RateLimiter
+	AdjustCost(userId string, delta int64)
+}
+
+// A RateLimiter which holds back some of its capacity for more important requests,
+// so that as capacity runs low the least important requests are refused first.
+type PriorityRateLimiter interface {
+	RateLimiter
+	DecideWithPriority(userId string, requestCost uint64, priority Priority) Decision
+}
+
+// Adapts a plain RateLimiter so that callers may always work in terms of Decisions.
+// Only the Allowed field is meaningful for limiters which cannot explain themselves.
+func Decide(limiter RateLimiter, userId string, requestCost uint64) Decision {
+	if decider, ok := limiter.(DecidingRateLimiter); ok {
+		return decider.Decide(userId, requestCost)
+	}
+	return Decision{Allowed: limiter.AttemptAccess(userId, requestCost)}
+}
+
+// The decision made by Middleware for the request currently being served, if any.
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(Decision)
+	return decision, ok
+}
+
 func StdMiddleware(
 	limiter RateLimiter,
 ) func(servlet http.Handler) http.HandlerFunc {
@@ -23,23 +74,73 @@ func Middleware(
 	limiter RateLimiter,
 	tenantIdentifier func(r *http.Request) string,
 	costOfRequest func(req *http.Request) uint64,
+	options ...MiddlewareOption,
 ) func(servlet http.Handler) http.HandlerFunc {
+	config := newMiddlewareConfig(options)
+	queue := config.newFairQueue()
 	return func(servlet http.Handler) http.HandlerFunc {
 		return func(resp http.ResponseWriter, req *http.Request) {
+			limiter := limiter
+			if config.routes != nil {
+				if match, ok := config.routes.Match(req); ok {
+					req = req.WithContext(context.WithValue(req.Context(), routeKey{}, match))
+					if match.Route.Limit.Limiter != nil {
+						limiter = withRouteLimit(limiter, match.Route.Limit)
+					}
+				}
+			}
 			tenantId := tenantIdentifier(req)
 
-			if limiter.AttemptAccess(tenantId, costOfRequest(req)) {
+			estimate := costOfRequest(req)
+			config.evaluateShadows(req, tenantId, estimate)
+			decide := config.decider(limiter, req, tenantId, estimate)
+			var decision Decision
+			var rejection int
+			queued := false
+			if queue != nil {
+				decision, rejection, queued = queue.join(req.Context(), tenantId, estimate, decide)
+			}
+			if !queued {
+				decision = decide()
+				if !decision.Allowed && config.dryRun != nil {
+					config.dryRun(req, Rejection{TenantId: tenantId, Status: http.StatusTooManyRequests, Decision: decision})
+					servlet.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), decisionKey{}, decision)))
+					return
+				}
+				rejection = http.StatusTooManyRequests
+				if !decision.Allowed && queue != nil {
+					decision, rejection = queue.wait(req.Context(), tenantId, estimate, decision, decide)
+				}
+			}
+
+			if config.dryRun == nil {
+				config.headers.write(resp.Header(), decision, config.clock.Now())
+			}
+			if decision.Allowed {
+				ctx := context.WithValue(req.Context(), decisionKey{}, decision)
+				if adjustable, ok := limiter.(AdjustableRateLimiter); ok {
+					settlement := &costSettlement{estimate: estimate}
+					ctx = context.WithValue(ctx, costSettlementKey{}, settlement)
+					defer settlement.settle(adjustable, tenantId)
+				}
+				req = req.WithContext(ctx)
+				if config.metering != nil && config.dryRun == nil {
+					resp, req = config.metering.wrap(limiter, tenantId, resp, req)
+				}
 				servlet.ServeHTTP(resp, req)
 				return
 			} // else access attempt failed
 
-			resp.WriteHeader(http.StatusTooManyRequests)
-			io.WriteString(resp, "Throttle limit exceeded.")
+			ctx := context.WithValue(req.Context(), decisionKey{}, decision)
+			ctx = context.WithValue(ctx, rejectionKey{}, Rejection{TenantId: tenantId, Status: rejection, Decision: decision})
+			config.rejection.ServeHTTP(resp, req.WithContext(ctx))
 			return
 		}
 	}
 }
 
+type decisionKey struct{}
+
 ///////// DEPENDS ON /////////
 
 // Abstracts over time.Now, see TimeStamp
@@ -47,13 +148,20 @@ type Clock interface {
 	Now() time.Time
 }
 
+// Clocks which can also stand in for time.After, so that whatever waits on them keeps
+// the same time as everything else, see WithClock.
+type AlarmClock interface {
+	Clock
+	After(d time.Duration) <-chan time.Time
+}
+
 type Logger interface {
 	Error(msg string)
 }
 
 ///////// Simple Dependency Implementations /////////
 
-var _ Clock = HardwareClock{}
+var _ AlarmClock = HardwareClock{}
 
 type HardwareClock struct{}
 
@@ -61,19 +169,25 @@ func (_ HardwareClock) Now() time.Time {
 	return time.Now()
 }
 
+func (_ HardwareClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
 type StdOutLogger struct{}
 
 func (_ StdOutLogger) Error(msg string) {
 	fmt.Printf("%s", msg)
 }
 
+// Every connection is its own tenant, since RemoteAddr includes the client's port.
+// See ClientIPIdentifier to limit clients by address, including behind proxies.
 func UniqueTenantIdentifier(req *http.Request) string {
 	return req.RemoteAddr
 }
 
 // a small nod to the fact that requests are not all created equal.
 // if some requests would take an order of magnitude more work to service,
-// then we probably need to treat user resource usage more carefully.
+// then we probably need to treat user resource usage more carefully, see RouteTable.
 func FixedRequestCost(req *http.Request) uint64 {
 	return 1
 }
\ No newline at end of file